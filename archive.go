@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archivePath returns the path of the archive of a capture run, e.g. mqtt-trace-20240115-103045.tar.gz
+func archivePath(outputFile string, t time.Time) string {
+	base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	return fmt.Sprintf("%s-%s.tar.gz", base, t.Format("20060102-150405"))
+}
+
+// writeArchive writes the files to a gzipped tarball at path. Files that
+// don't exist (e.g. an errors file nothing was written to) or are not
+// configured (empty paths) are skipped.
+func writeArchive(path string, files []string) (err error) {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to write archive: %w", closeErr)
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		if err := addToArchive(tw, file); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// addToArchive appends a file to the tarball under its base name
+func addToArchive(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+	header.Name = filepath.Base(path)
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+	if _, err := io.Copy(tw, file); err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+	return nil
+}
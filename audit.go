@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// AuditLog appends the connection lifecycle events to a dedicated file, in
+// the format: <date>|event=<event>|<key>=<value>... Each event is synced to
+// disk before returning, so the file survives crashes. A nil AuditLog records
+// nothing.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// broker is the host:port of the broker connections are made to
+	broker string
+}
+
+// NewAuditLog creates an audit log appending to filePath, connections being
+// made to broker, or returns nil if filePath is empty
+func NewAuditLog(filePath, broker string) (*AuditLog, error) {
+	if filePath == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	return &AuditLog{file: file, broker: broker}, nil
+}
+
+// Record appends an event with its fields, in key order
+func (a *AuditLog) Record(event string, fields map[string]string) {
+	if a == nil {
+		return
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Keep the values on a single line and the separator unambiguous
+	replacer := strings.NewReplacer("\n", " ", "|", "/")
+	line := time.Now().Format(time.RFC3339) + "|event=" + event
+	for _, key := range keys {
+		line += fmt.Sprintf("|%s=%s", key, replacer.Replace(fields[key]))
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.WriteString(line + "\n"); err != nil {
+		log.Printf("Error writing to audit file: %v", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		log.Printf("Error syncing audit file: %v", err)
+	}
+}
+
+// Notify records the connection lifecycle as a connection notification
+// handler: the connection attempts, reconnections included, their outcome,
+// telling the refused credentials apart, and the lost connections
+func (a *AuditLog) Notify(client mqtt.Client, notification mqtt.ConnectionNotification) {
+	if a == nil {
+		return
+	}
+	switch n := notification.(type) {
+	case mqtt.ConnectionNotificationConnecting:
+		event := "connecting"
+		if n.IsReconnect {
+			event = "reconnecting"
+		}
+		a.Record(event, map[string]string{"attempt": fmt.Sprint(n.Attempt)})
+	case mqtt.ConnectionNotificationConnected:
+		a.mu.Lock()
+		broker := a.broker
+		a.mu.Unlock()
+		a.Record("connect", map[string]string{"broker": broker})
+	case mqtt.ConnectionNotificationFailed:
+		event := "connect_failed"
+		if isAuthFailure(n.Reason) {
+			event = "auth_failure"
+		}
+		a.Record(event, map[string]string{"error": n.Reason.Error()})
+	case mqtt.ConnectionNotificationLost:
+		reason := "unknown"
+		if n.Reason != nil {
+			reason = n.Reason.Error()
+		}
+		a.Record("connection_lost", map[string]string{"error": reason})
+	}
+}
+
+// SetBroker changes the broker the next connections are made to, e.g.
+// after a failover
+func (a *AuditLog) SetBroker(broker string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.broker = broker
+}
+
+// Close closes the audit file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a record deviates from the baseline
+const (
+	// anomalyNewTopic is a topic without any record in the baseline
+	anomalyNewTopic = "new_topic"
+	// anomalyMissingField is an output field found in every baseline record
+	// of the topic, missing from the message
+	anomalyMissingField = "missing_field"
+	// anomalyOutOfRange is a number outside the range of the field in the
+	// baseline
+	anomalyOutOfRange = "out_of_range"
+)
+
+// BaselineConfig compares the records to a previous trace
+type BaselineConfig struct {
+	// File is the baseline trace, in the line or influx format, disabled
+	// when empty
+	File string `mapstructure:"file"`
+	// ReportFile is where the records deviating from the baseline are
+	// reported
+	ReportFile string `mapstructure:"report_file"`
+	// Tolerance widens the range of the numbers by this fraction of it on
+	// each side
+	Tolerance float64 `mapstructure:"tolerance"`
+}
+
+// baselineProfile is what the baseline records of a topic look like
+type baselineProfile struct {
+	records int
+	fields  map[string]*baselineField
+}
+
+// baselineField is what the values of a field look like in the baseline
+type baselineField struct {
+	// seen is the number of records holding the field
+	seen int
+	// numeric tells whether all its values are numbers, in [min, max]
+	numeric  bool
+	min, max float64
+}
+
+// baselineAnomaly is a way a record deviates from the baseline
+type baselineAnomaly struct {
+	reason string
+	// field, value and the range are unset for a new topic, the range for a
+	// missing field
+	field    string
+	value    float64
+	min, max float64
+}
+
+// Baseline compares the records to the profiles of the topics of a baseline
+// trace, reporting the deviations to a file created on the first one. A nil
+// Baseline compares nothing.
+type Baseline struct {
+	profiles  map[string]*baselineProfile
+	tolerance float64
+
+	mu         sync.Mutex
+	reportPath string
+	report     *os.File
+}
+
+// LoadBaseline profiles the records of the baseline trace at path, or
+// returns nil if path is empty
+func LoadBaseline(path, reportPath string, tolerance float64) (*Baseline, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open baseline: %w", err)
+	}
+	defer file.Close()
+
+	b := &Baseline{
+		profiles:   make(map[string]*baselineProfile),
+		tolerance:  tolerance,
+		reportPath: reportPath,
+	}
+	reader := bufio.NewReader(file)
+	records := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if line = strings.TrimSuffix(line, "\n"); line != "" && b.add(line) {
+			records++
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read baseline: %w", err)
+		}
+	}
+	if records == 0 {
+		return nil, fmt.Errorf("no record found in baseline %s", path)
+	}
+
+	topics := len(b.profiles)
+	if _, ok := b.profiles[""]; ok {
+		topics--
+	}
+	log.Printf("Loaded baseline of %d records on %d topics from %s", records, topics, path)
+	return b, nil
+}
+
+// add profiles a line of the baseline, and tells whether it is a message
+// record. Events are left out: those of the line format start with their
+// event field, those of the influx format have no topic tag, unlike its
+// messages.
+func (b *Baseline) add(line string) bool {
+	record, ok := parseRecord(line)
+	if !ok || len(record.fields) == 0 {
+		return false
+	}
+	date, _, _ := strings.Cut(line, "|")
+	if _, err := time.Parse(time.RFC3339, date); err != nil {
+		if record.topic == "" {
+			return false
+		}
+	} else if record.fields[0].key == "event" {
+		return false
+	}
+
+	profile, ok := b.profiles[record.topic]
+	if !ok {
+		profile = &baselineProfile{fields: make(map[string]*baselineField)}
+		b.profiles[record.topic] = profile
+	}
+	profile.records++
+	for _, f := range record.fields {
+		value := fmt.Sprint(f.value)
+		// Missing fields are written as null or empty with missing_field
+		if f.key == "topic" || value == "null" || value == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.TrimRight(value, "iu"), 64)
+		bf, ok := profile.fields[f.key]
+		if !ok {
+			bf = &baselineField{numeric: err == nil, min: number, max: number}
+			profile.fields[f.key] = bf
+		}
+		bf.seen++
+		if err != nil {
+			bf.numeric = false
+			continue
+		}
+		bf.min = math.Min(bf.min, number)
+		bf.max = math.Max(bf.max, number)
+	}
+	return true
+}
+
+// Compare returns how a message of topic deviates from the baseline, looking
+// at its output fields. Baseline records without a topic, as in the line
+// format, make up the profile of the topics without records of their own.
+func (b *Baseline) Compare(topic string, payload map[string]any, outputFields []string) []baselineAnomaly {
+	if b == nil {
+		return nil
+	}
+	profile, ok := b.profiles[topic]
+	if !ok {
+		if profile, ok = b.profiles[""]; !ok {
+			return []baselineAnomaly{{reason: anomalyNewTopic}}
+		}
+	}
+
+	var anomalies []baselineAnomaly
+	for _, name := range outputFields {
+		bf, ok := profile.fields[name]
+		if !ok {
+			continue
+		}
+		value, present := payload[name]
+		if !present || value == nil {
+			if bf.seen == profile.records {
+				anomalies = append(anomalies, baselineAnomaly{reason: anomalyMissingField, field: name})
+			}
+			continue
+		}
+		number, ok := value.(float64)
+		if i, isInt := value.(int); isInt {
+			number, ok = float64(i), true
+		}
+		if !ok || !bf.numeric {
+			continue
+		}
+		margin := b.tolerance * (bf.max - bf.min)
+		if number < bf.min-margin || number > bf.max+margin {
+			anomalies = append(anomalies, baselineAnomaly{reason: anomalyOutOfRange, field: name, value: number, min: bf.min, max: bf.max})
+		}
+	}
+	return anomalies
+}
+
+// Report appends the anomalies of a message of topic to the report file, one
+// per line in the format: <date>|topic=<topic>|reason=<reason>[|field=<field>
+// [|value=<value>|min=<min>|max=<max>]]
+func (b *Baseline) Report(topic string, anomalies []baselineAnomaly) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.report == nil {
+		file, err := openOutputFile(b.reportPath)
+		if err != nil {
+			return err
+		}
+		b.report = file
+	}
+
+	var lines strings.Builder
+	date := time.Now().Format(time.RFC3339)
+	for _, a := range anomalies {
+		fmt.Fprintf(&lines, "%s|topic=%s|reason=%s", date, topic, a.reason)
+		if a.field != "" {
+			fmt.Fprintf(&lines, "|field=%s", a.field)
+		}
+		if a.reason == anomalyOutOfRange {
+			fmt.Fprintf(&lines, "|value=%v|min=%v|max=%v", a.value, a.min, a.max)
+		}
+		lines.WriteString("\n")
+	}
+	if _, err := b.report.WriteString(lines.String()); err != nil {
+		return fmt.Errorf("failed to write to baseline report: %w", err)
+	}
+	return nil
+}
+
+// Close closes the report file if it was created
+func (b *Baseline) Close() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.report == nil {
+		return nil
+	}
+	return b.report.Close()
+}
+
+// anomalyReasons returns the reasons of anomalies, each once, comma-separated
+func anomalyReasons(anomalies []baselineAnomaly) string {
+	var reasons []string
+	for _, a := range anomalies {
+		if !slices.Contains(reasons, a.reason) {
+			reasons = append(reasons, a.reason)
+		}
+	}
+	return strings.Join(reasons, ",")
+}
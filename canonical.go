@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"unicode/utf16"
+)
+
+// canonicalJSON encodes v as canonical JSON, following RFC 8785: object keys
+// sorted by their UTF-16 code units, no whitespace, and strings only escaped
+// where JSON requires it, so that equal values always encode to the same
+// bytes. Numbers are written as encoding/json formats them, which matches the
+// RFC for floats; integers are written as is.
+func canonicalJSON(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode the generic value back, keeping the numbers as encoded
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeCanonical(&buf, value)
+	return buf.Bytes(), nil
+}
+
+// writeCanonical writes a decoded JSON value as canonical JSON
+func writeCanonical(buf *bytes.Buffer, value any) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		fmt.Fprint(buf, v)
+	case json.Number:
+		buf.WriteString(v.String())
+	case string:
+		writeCanonicalString(buf, v)
+	case []any:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonical(buf, item)
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, func(a, b string) int {
+			return slices.Compare(utf16.Encode([]rune(a)), utf16.Encode([]rune(b)))
+		})
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			writeCanonical(buf, v[key])
+		}
+		buf.WriteByte('}')
+	}
+}
+
+// writeCanonicalString writes a quoted string, escaping only the quote, the
+// backslash and the control characters, with their short form if any
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// canonicalFields replaces the object and array values of fields with their
+// canonical JSON, for the formats writing values as text
+func canonicalFields(fields []field) ([]field, error) {
+	canonical := make([]field, len(fields))
+	for i, f := range fields {
+		canonical[i] = f
+		switch f.value.(type) {
+		case map[string]any, []any:
+			data, err := canonicalJSON(f.value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode field %s: %w", f.key, err)
+			}
+			canonical[i].value = string(data)
+		}
+	}
+	return canonical, nil
+}
+
+// encodeJSON encodes records for the grouped and state files, as canonical
+// JSON when enabled, else indented with indent if not empty
+func (fw *FileWriter) encodeJSON(v any, indent string) ([]byte, error) {
+	if !fw.canonical {
+		return encodeRecords(v, indent, fw.escapeHTML)
+	}
+	data, err := canonicalJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
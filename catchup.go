@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// CatchUp detects the burst of messages a broker delivers right after a
+// connection (queued messages of a persistent session, retained messages),
+// so it can be told apart from live traffic. The burst starts at each
+// connection and ends at the first gap between two messages longer than gap,
+// or after window at most.
+type CatchUp struct {
+	mu     sync.Mutex
+	window time.Duration
+	gap    time.Duration
+
+	active bool
+	until  time.Time
+	last   time.Time
+	count  int
+}
+
+// NewCatchUp creates a catch-up detector
+func NewCatchUp(window, gap time.Duration) *CatchUp {
+	return &CatchUp{
+		window: window,
+		gap:    gap,
+	}
+}
+
+// Start begins a new catch-up burst, it is called when the client connects
+func (c *CatchUp) Start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.active = true
+	c.until = now.Add(c.window)
+	c.last = now
+	c.count = 0
+}
+
+// Observe reports whether a message received at t belongs to the catch-up burst
+func (c *CatchUp) Observe(t time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.active {
+		return false
+	}
+	if t.After(c.until) || t.Sub(c.last) > c.gap {
+		c.active = false
+		log.Printf("Caught up after %d messages, switching to live traffic", c.count)
+		return false
+	}
+
+	c.last = t
+	c.count++
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// Checksum algorithms
+const (
+	checksumCRC32  = "crc32"
+	checksumCRC32C = "crc32c"
+	checksumMD5    = "md5"
+	checksumSHA256 = "sha256"
+)
+
+// Policies applied when a payload checksum doesn't match
+const (
+	checksumFailureFlag = "flag"
+	checksumFailureDrop = "drop"
+)
+
+// ChecksumConfig verifies a checksum devices put in their payloads
+type ChecksumConfig struct {
+	// Field is the payload field holding the checksum, disabled when empty
+	Field     string `mapstructure:"field"`
+	Algorithm string `mapstructure:"algorithm"`
+	// Fields are the payload fields covered by the checksum, all but
+	// Field when empty
+	Fields []string `mapstructure:"fields"`
+	// Topics are the topic filters of the payloads carrying a checksum, all
+	// when empty
+	Topics []string `mapstructure:"topics"`
+	// OnFailure is flag or drop
+	OnFailure string `mapstructure:"on_failure"`
+}
+
+// newChecksumHash returns a hash for a checksum algorithm, nil if unknown
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case checksumCRC32:
+		return crc32.NewIEEE()
+	case checksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case checksumMD5:
+		return md5.New()
+	case checksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// verifyChecksum checks the checksum of a payload: the hash of the canonical
+// JSON of the object holding the covered fields. It returns why the payload
+// fails, empty if it passes.
+func verifyChecksum(payload map[string]any, c ChecksumConfig) string {
+	value, ok := payload[c.Field]
+	if !ok {
+		return "missing"
+	}
+	expected, ok := checksumValue(value, c.Algorithm)
+	if !ok {
+		return "invalid"
+	}
+
+	covered := make(map[string]any, len(payload))
+	if len(c.Fields) == 0 {
+		for key, value := range payload {
+			if key != c.Field {
+				covered[key] = value
+			}
+		}
+	} else {
+		for _, key := range c.Fields {
+			if value, ok := payload[key]; ok {
+				covered[key] = value
+			}
+		}
+	}
+	data, err := canonicalJSON(covered)
+	if err != nil {
+		return "invalid"
+	}
+
+	h := newChecksumHash(c.Algorithm)
+	h.Write(data)
+	if hex.EncodeToString(h.Sum(nil)) != expected {
+		return "mismatch"
+	}
+	return ""
+}
+
+// checksumValue returns the checksum of a payload in lowercase hex: given
+// as a hex string, or as a number for CRC-32 checksums
+func checksumValue(value any, algorithm string) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return strings.ToLower(v), v != ""
+	case float64:
+		if algorithm != checksumCRC32 && algorithm != checksumCRC32C || v < 0 || v != float64(uint32(v)) {
+			return "", false
+		}
+		return fmt.Sprintf("%08x", uint32(v)), true
+	}
+	return "", false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// maxSocketBuffer is the largest accepted socket buffer size
+const maxSocketBuffer = 64 << 20
+
+// newOpenConnectionFn returns a function opening the broker connection with
+// the given socket buffer sizes, 0 keeping the OS default. The durations of
+// the connection phases are reported to timing if not nil.
+func newOpenConnectionFn(readBuffer, writeBuffer int, timing *ConnectTiming) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		start := time.Now()
+		conn, err := options.Dialer.Dial("tcp", uri.Host)
+		if err != nil {
+			return nil, err
+		}
+		dialed := time.Now()
+
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			if readBuffer > 0 {
+				if err := tcp.SetReadBuffer(readBuffer); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("failed to set read buffer: %w", err)
+				}
+			}
+			if writeBuffer > 0 {
+				if err := tcp.SetWriteBuffer(writeBuffer); err != nil {
+					conn.Close()
+					return nil, fmt.Errorf("failed to set write buffer: %w", err)
+				}
+			}
+		}
+
+		if uri.Scheme != "ssl" {
+			if timing != nil {
+				timing.opened(dialed.Sub(start), 0)
+			}
+			return conn, nil
+		}
+
+		// Like tls.Dial, verify the certificate against the broker host name
+		tlsConfig := options.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = uri.Hostname()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), options.ConnectTimeout)
+		defer cancel()
+
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if timing != nil {
+			timing.opened(dialed.Sub(start), time.Since(dialed))
+		}
+		return tlsConn, nil
+	}
+}
+
+// ConnectTiming measures how long the phases of a connection to the broker
+// take: TCP connect, TLS handshake and MQTT CONNECT/CONNACK
+type ConnectTiming struct {
+	mu       sync.Mutex
+	tcp      time.Duration
+	tls      time.Duration
+	openedAt time.Time
+	logged   bool
+}
+
+// opened records the network connection being established, the MQTT
+// handshake starts right after
+func (t *ConnectTiming) opened(tcp, tls time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tcp = tcp
+	t.tls = tls
+	t.openedAt = time.Now()
+}
+
+// connected records the CONNACK, it is called from the OnConnect handler.
+// The timing of the first connection is logged, the metrics are updated on
+// every connection.
+func (t *ConnectTiming) connected() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.openedAt.IsZero() {
+		return
+	}
+	handshake := time.Since(t.openedAt)
+	t.openedAt = time.Time{}
+
+	connectDuration.WithLabelValues("tcp").Set(t.tcp.Seconds())
+	connectDuration.WithLabelValues("tls").Set(t.tls.Seconds())
+	connectDuration.WithLabelValues("mqtt").Set(handshake.Seconds())
+
+	if !t.logged {
+		log.Printf("Connection timing: tcp=%s tls=%s mqtt=%s", t.tcp, t.tls, handshake)
+		t.logged = true
+	}
+}
+
+// authFailureHandler returns a connection notification handler closing
+// failed when the broker refuses the credentials, which retrying can't fix
+func authFailureHandler(failed chan<- error) mqtt.ConnectionNotificationHandler {
+	var once sync.Once
+	return func(client mqtt.Client, notification mqtt.ConnectionNotification) {
+		n, ok := notification.(mqtt.ConnectionNotificationFailed)
+		if !ok || !isAuthFailure(n.Reason) {
+			return
+		}
+		once.Do(func() {
+			failed <- n.Reason
+		})
+	}
+}
+
+// notificationHandlers returns a connection notification handler calling
+// each of handlers in turn
+func notificationHandlers(handlers ...mqtt.ConnectionNotificationHandler) mqtt.ConnectionNotificationHandler {
+	return func(client mqtt.Client, notification mqtt.ConnectionNotification) {
+		for _, handler := range handlers {
+			handler(client, notification)
+		}
+	}
+}
+
+// isAuthFailure reports whether a connection error is a CONNACK refusing the
+// credentials (bad user name or password) or the client (not authorized)
+func isAuthFailure(err error) bool {
+	return errors.Is(err, packets.ErrorRefusedBadUsernameOrPassword) || errors.Is(err, packets.ErrorRefusedNotAuthorised)
+}
+
+// logConnectionParams logs the effective parameters the client connects with, the password redacted
+func logConnectionParams(options mqtt.ClientOptionsReader, qos byte) {
+	servers := make([]string, len(options.Servers()))
+	for i, server := range options.Servers() {
+		servers[i] = server.String()
+	}
+
+	// Protocol version 0 means 3.1.1, falling back to 3.1 if refused
+	protocol := "3.1.1"
+	switch options.ProtocolVersion() {
+	case 3:
+		protocol = "3.1"
+	case 0:
+		protocol = "3.1.1 (3.1 fallback)"
+	}
+
+	password := ""
+	if options.Password() != "" {
+		password = "<redacted>"
+	}
+
+	log.Printf("Connection parameters: brokers=%s client_id=%s username=%q password=%s clean_session=%t keep_alive=%s qos=%d tls=%t protocol=%s",
+		strings.Join(servers, ","), options.ClientID(), options.Username(), password,
+		options.CleanSession(), options.KeepAlive(), qos, options.TLSConfig() != nil, protocol)
+}
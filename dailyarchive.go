@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// manifestFileName is the name of the manifest of each archive directory
+const manifestFileName = "manifest.json"
+
+// archiveManifest describes the files of an archive directory, so an archive
+// can be checked and searched without decompressing it
+type archiveManifest struct {
+	Period string          `json:"period"`
+	Files  []manifestEntry `json:"files"`
+}
+
+// manifestEntry describes one archived file
+type manifestEntry struct {
+	File     string `json:"file"`
+	Source   string `json:"source"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	First    string `json:"first,omitempty"`
+	Last     string `json:"last,omitempty"`
+	Records  uint64 `json:"records"`
+	Archived string `json:"archived"`
+}
+
+// dailyArchiveDir returns the archive directory of a day, e.g. archive/2024-01-15
+// next to the output files
+func dailyArchiveDir(outputFile, day string) string {
+	return filepath.Join(filepath.Dir(outputFile), "archive", day)
+}
+
+// archiveDailyFile compresses a finished daily file into dir, records it in
+// the manifest of dir and removes it. The file is only removed once the
+// compressed copy and the manifest are safely written.
+func archiveDailyFile(path, dir, day, format string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	entry, err := compressFile(path, filepath.Join(dir, filepath.Base(path)+".gz"), format)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(dir, manifestFileName)
+	manifest := archiveManifest{Period: day}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("failed to parse manifest %s: %w", manifestPath, err)
+		}
+	}
+
+	// Archiving a file again replaces its entry
+	replaced := false
+	for i := range manifest.Files {
+		if manifest.Files[i].File == entry.File {
+			manifest.Files[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFileAtomic(manifestPath, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove archived file: %w", err)
+	}
+	return nil
+}
+
+// compressFile gzips src to dst, returning the manifest entry of dst: its
+// checksum and the time range and number of the records of src
+func compressFile(src, dst, format string) (entry manifestEntry, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+	defer in.Close()
+
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	// The checksum is the one of the compressed file, as stored
+	sum := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, sum)}
+	gz := gzip.NewWriter(counter)
+
+	entry = manifestEntry{
+		File:   filepath.Base(dst),
+		Source: filepath.Base(src),
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, err := io.WriteString(gz, line+"\n"); err != nil {
+			return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+		}
+		if t := lineTime(line, format); t != "" {
+			if entry.First == "" {
+				entry.First = t
+			}
+			entry.Last = t
+		}
+		entry.Records++
+	}
+	if err := scanner.Err(); err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+
+	if err := gz.Close(); err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return entry, fmt.Errorf("failed to archive %s: %w", src, err)
+	}
+
+	entry.Size = counter.n
+	entry.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	entry.Archived = time.Now().Format(time.RFC3339)
+	return entry, nil
+}
+
+// lineTime returns the time of a record line as RFC 3339, or "" if it has none
+func lineTime(line, format string) string {
+	if format == outputFormatInflux {
+		// Line protocol ends with the timestamp in nanoseconds
+		i := strings.LastIndexByte(line, ' ')
+		ns, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if i < 0 || err != nil {
+			return ""
+		}
+		return time.Unix(0, ns).UTC().Format(time.RFC3339)
+	}
+	date, _, ok := strings.Cut(line, "|")
+	if !ok {
+		return ""
+	}
+	return date
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// hashLRU remembers the most recently seen hashes, up to a size
+type hashLRU struct {
+	mu    sync.Mutex
+	size  int // maximum number of hashes kept, 0 for no limit
+	order *list.List
+	seen  map[[sha256.Size]byte]*list.Element
+}
+
+// newHashLRU creates a set remembering up to size hashes, or all of them if size is 0
+func newHashLRU(size int) *hashLRU {
+	return &hashLRU{
+		size:  size,
+		order: list.New(),
+		seen:  make(map[[sha256.Size]byte]*list.Element),
+	}
+}
+
+// add reports whether sum was already seen. Otherwise it is remembered,
+// evicting the least recently seen hash if the set is full.
+func (l *hashLRU) add(sum [sha256.Size]byte) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if elem, ok := l.seen[sum]; ok {
+		l.order.MoveToFront(elem)
+		return true
+	}
+
+	l.seen[sum] = l.order.PushFront(sum)
+	if l.size > 0 && l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.seen, oldest.Value.([sha256.Size]byte))
+	}
+	return false
+}
+
+// topicHash hashes data received on topic
+func topicHash(topic string, data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(topic))
+	h.Write([]byte{0})
+	h.Write(data)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// DistinctPayloads remembers the hashes of the most recently seen payloads of
+// each topic, so a payload is only recorded the first time it is seen
+type DistinctPayloads struct {
+	seen    *hashLRU
+	repeats atomic.Uint64
+}
+
+// NewDistinctPayloads creates a set remembering up to size payloads, or all of them if size is 0
+func NewDistinctPayloads(size int) *DistinctPayloads {
+	return &DistinctPayloads{seen: newHashLRU(size)}
+}
+
+// Seen reports whether payload was already received on topic, counting it
+// as a repeat if so. Otherwise it is remembered, evicting the least recently
+// seen payload if the set is full.
+func (d *DistinctPayloads) Seen(topic string, payload []byte) bool {
+	if !d.seen.add(topicHash(topic, payload)) {
+		return false
+	}
+	d.repeats.Add(1)
+	repeatedPayloads.Inc()
+	return true
+}
+
+// Repeats returns the number of repeated payloads not recorded
+func (d *DistinctPayloads) Repeats() uint64 {
+	return d.repeats.Load()
+}
+
+// IdentityDedup remembers the most recently seen values of an identity
+// payload field of each topic, such as a message ID set by the device, so
+// that a message is only recorded the first time its ID is seen
+type IdentityDedup struct {
+	field string
+	seen  *hashLRU
+}
+
+// NewIdentityDedup creates a set remembering up to size IDs of field, or all
+// of them if size is 0
+func NewIdentityDedup(field string, size int) *IdentityDedup {
+	return &IdentityDedup{field: field, seen: newHashLRU(size)}
+}
+
+// Seen reports whether the ID of a payload was already received on topic,
+// remembering it otherwise. Payloads without an ID, or with a null one, are
+// never seen.
+func (d *IdentityDedup) Seen(topic string, payload map[string]any) bool {
+	value, ok := payloadField(payload, d.field)
+	if !ok || value == nil {
+		return false
+	}
+	// Encoded as JSON, the ID "1" differs from 1
+	id, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	return d.seen.add(topicHash(topic, id))
+}
+
+// redeliveryKey identifies a message for redelivery detection: a redelivered
+// message has the same packet ID, topic and payload as the original
+func redeliveryKey(msg mqtt.Message) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{byte(msg.MessageID() >> 8), byte(msg.MessageID())})
+	h.Write([]byte(msg.Topic()))
+	h.Write([]byte{0})
+	h.Write(msg.Payload())
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
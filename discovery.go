@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// discoveryQueueSize bounds the discovery updates waiting to be applied, the
+// next ones being dropped
+const discoveryQueueSize = 100
+
+// Discovery watches discovery topics (e.g. Home Assistant's
+// homeassistant/+/+/config) and subscribes to the topics referenced by the
+// discovery payloads, unsubscribing once no payload references them anymore
+type Discovery struct {
+	subs   *Subscriptions
+	static map[string]byte // topics from the configuration, never unsubscribed
+	fields []string
+	qos    byte
+
+	// sources are the topics referenced by each discovery topic, refs the
+	// number of discovery topics referencing each topic
+	sources map[string][]string
+	refs    map[string]int
+
+	updates chan mqtt.Message
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewDiscovery creates a discovery adding the referenced topics to subs. The
+// topics are read from the given payload fields.
+func NewDiscovery(subs *Subscriptions, static map[string]byte, fields []string, qos byte) *Discovery {
+	return &Discovery{
+		subs:    subs,
+		static:  static,
+		fields:  fields,
+		qos:     qos,
+		sources: make(map[string][]string),
+		refs:    make(map[string]int),
+		updates: make(chan mqtt.Message, discoveryQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// HandleMessage queues a discovery message. Subscribing waits for the broker,
+// which must not be done from a message handler, so updates are applied in
+// the background. The queue is never waited for, not to hold back the other
+// messages: updates are dropped while it is full.
+func (d *Discovery) HandleMessage(client mqtt.Client, msg mqtt.Message) {
+	select {
+	case d.updates <- msg:
+	default:
+		discoveryDropped.Inc()
+		log.Printf("Discovery queue full, dropping update from %s", msg.Topic())
+	}
+}
+
+// Start applies the queued discovery updates in the background until Stop is called
+func (d *Discovery) Start(client mqtt.Client) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case msg := <-d.updates:
+				d.apply(client, msg)
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops applying discovery updates
+func (d *Discovery) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// apply updates the subscriptions for a discovery message. An empty payload
+// removes the device, as with Home Assistant.
+func (d *Discovery) apply(client mqtt.Client, msg mqtt.Message) {
+	var topics []string
+	if len(msg.Payload()) > 0 {
+		var payload map[string]any
+		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
+			log.Printf("Error unmarshaling discovery message from topic %s: %v", msg.Topic(), err)
+			return
+		}
+		topics = d.referencedTopics(payload)
+	}
+
+	previous := d.sources[msg.Topic()]
+	for _, topic := range topics {
+		if slices.Contains(previous, topic) {
+			continue
+		}
+		if d.refs[topic]++; d.refs[topic] > 1 || d.isStatic(topic) {
+			continue
+		}
+		if err := d.subs.Add(client, topic, d.qos); err != nil {
+			log.Printf("Error subscribing to discovered topic: %v", err)
+			continue
+		}
+		log.Printf("Discovered topic %s from %s", topic, msg.Topic())
+	}
+	for _, topic := range previous {
+		if slices.Contains(topics, topic) {
+			continue
+		}
+		if d.refs[topic]--; d.refs[topic] > 0 || d.isStatic(topic) {
+			continue
+		}
+		delete(d.refs, topic)
+		if err := d.subs.Remove(client, topic); err != nil {
+			log.Printf("Error unsubscribing from removed topic: %v", err)
+		}
+	}
+
+	if len(topics) == 0 {
+		delete(d.sources, msg.Topic())
+	} else {
+		d.sources[msg.Topic()] = topics
+	}
+}
+
+// referencedTopics returns the topics held by the configured fields of a
+// discovery payload, expanding the ~ abbreviation of the base topic
+func (d *Discovery) referencedTopics(payload map[string]any) []string {
+	base, _ := payload["~"].(string)
+
+	var topics []string
+	for _, name := range d.fields {
+		topic, ok := payload[name].(string)
+		if !ok || topic == "" {
+			continue
+		}
+		if base != "" {
+			if strings.HasPrefix(topic, "~") {
+				topic = base + topic[1:]
+			} else if strings.HasSuffix(topic, "~") {
+				topic = topic[:len(topic)-1] + base
+			}
+		}
+		if !slices.Contains(topics, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// isStatic reports whether topic is one of the configured topics
+func (d *Discovery) isStatic(topic string) bool {
+	_, ok := d.static[topic]
+	return ok
+}
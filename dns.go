@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// dnsTimeout bounds the broker host resolution check
+const dnsTimeout = 10 * time.Second
+
+// checkBrokerHost makes sure the broker host name resolves. IP literals are not checked.
+func checkBrokerHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+		return fmt.Errorf("broker host %s is not resolvable: %w", host, err)
+	}
+	return nil
+}
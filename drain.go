@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// drainQuiet is how long no message must be handled for the handler to be
+// considered drained
+const drainQuiet = 200 * time.Millisecond
+
+// drainMessages stops the flow of messages before shutting down: it
+// unsubscribes from all topics, then waits for the messages already received
+// to be handled, for up to timeout. Messages sent by the broker before it
+// acknowledged the unsubscription can still be queued in the client, so
+// the handler has to stay idle for drainQuiet.
+func drainMessages(client mqtt.Client, handler *Handler, timeout time.Duration, subs ...*Subscriptions) {
+	deadline := time.Now().Add(timeout)
+	before := handler.handled.Load()
+
+	for _, s := range subs {
+		if s == nil {
+			continue
+		}
+		if err := s.UnsubscribeAll(client, time.Until(deadline)); err != nil {
+			log.Printf("Error unsubscribing before shutdown: %v", err)
+		}
+	}
+
+	last := handler.handled.Load()
+	quietSince := time.Now()
+	for time.Now().Before(deadline) {
+		time.Sleep(drainQuiet / 4)
+		if n := handler.handled.Load(); n != last || handler.inflight.Load() > 0 {
+			last = n
+			quietSince = time.Now()
+			continue
+		}
+		if time.Since(quietSince) >= drainQuiet {
+			log.Printf("Drained %d messages after stopping", last-before)
+			return
+		}
+	}
+	log.Printf("Drain timed out after %s with %d messages in progress", timeout, handler.inflight.Load())
+}
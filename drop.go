@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a message is not recorded
+const (
+	dropParseError         = "parse_error"
+	dropShapeMismatch      = "shape_mismatch"
+	dropWriteError         = "write_error"
+	dropTransformError     = "transform_error"
+	dropFutureTime         = "future_timestamp"
+	dropDuplicate          = "duplicate"
+	dropDuplicateID        = "duplicate_id"
+	dropSampledOut         = "sampled_out"
+	dropRenameCollision    = "rename_collision"
+	dropControlChars       = "control_chars"
+	dropPromoteCollision   = "promote_collision"
+	dropTypeMismatch       = "type_mismatch"
+	dropStartupOverflow    = "startup_overflow"
+	dropOutOfSchedule      = "out_of_schedule"
+	dropChecksum           = "checksum_failure"
+	dropNormalizeCollision = "normalize_collision"
+	dropPaused             = "paused"
+	dropFieldMismatch      = "field_mismatch"
+	dropRepeatedPayload    = "repeated_payload"
+)
+
+// DropLog accounts for the messages that are not recorded, and optionally
+// appends each of them to a file in the format: <date>|reason=<reason>|topic=<topic>
+type DropLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	counts map[string]uint64
+}
+
+// NewDropLog creates a drop log writing to filePath, or only counting drops if filePath is empty
+func NewDropLog(filePath string) (*DropLog, error) {
+	d := &DropLog{
+		counts: make(map[string]uint64),
+	}
+
+	if filePath != "" {
+		file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dropped log: %w", err)
+		}
+		d.file = file
+	}
+
+	return d, nil
+}
+
+// Drop accounts for a message of topic that was not recorded for reason
+func (d *DropLog) Drop(topic, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.counts[reason]++
+
+	if d.file == nil {
+		return
+	}
+	line := fmt.Sprintf("%s|reason=%s|topic=%s\n", time.Now().Format(time.RFC3339), reason, topic)
+	if _, err := d.file.WriteString(line); err != nil {
+		log.Printf("Error writing to dropped log: %v", err)
+	}
+}
+
+// Total returns the number of messages dropped so far
+func (d *DropLog) Total() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var total uint64
+	for _, count := range d.counts {
+		total += count
+	}
+	return total
+}
+
+// Summary returns the drop counts per reason, e.g. "parse_error=2, shape_mismatch=5"
+func (d *DropLog) Summary() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reasons := make([]string, 0, len(d.counts))
+	for reason := range d.counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, len(reasons))
+	for i, reason := range reasons {
+		parts[i] = fmt.Sprintf("%s=%d", reason, d.counts[reason])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Close closes the dropped log file
+func (d *DropLog) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	return d.file.Close()
+}
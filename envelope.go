@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// envelopePlaceholder matches the placeholders of an envelope template, e.g.
+// {topic} or {payload.rssi}
+var envelopePlaceholder = regexp.MustCompile(`\{([a-z_]+)(?:\.([^{}]+))?\}`)
+
+// envelopeNames are the placeholders an envelope template can use
+var envelopeNames = []string{"date", "topic", "payload", "session_id", "broker"}
+
+// parseEnvelope parses an envelope template: a JSON object describing the
+// shape of the records, whose strings can hold placeholders
+func parseEnvelope(template string) (map[string]any, error) {
+	var envelope map[string]any
+	if err := json.Unmarshal([]byte(template), &envelope); err != nil {
+		return nil, fmt.Errorf("envelope must be a JSON object: %w", err)
+	}
+	if err := checkPlaceholders(envelope); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// checkPlaceholders reports the first unknown placeholder of a template value
+func checkPlaceholders(value any) error {
+	switch v := value.(type) {
+	case string:
+		for _, match := range envelopePlaceholder.FindAllStringSubmatch(v, -1) {
+			name, sub := match[1], match[2]
+			if !slices.Contains(envelopeNames, name) {
+				return fmt.Errorf("envelope placeholder %s is unknown, expected one of {%s}", match[0], strings.Join(envelopeNames, "}, {"))
+			}
+			if sub != "" && name != "payload" {
+				return fmt.Errorf("envelope placeholder %s can't select a field, only {payload.<field>} can", match[0])
+			}
+		}
+	case map[string]any:
+		for _, item := range v {
+			if err := checkPlaceholders(item); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if err := checkPlaceholders(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderEnvelope builds a record in the shape of envelope out of the
+// grouped record of a message. The payload is the record without its date,
+// session ID and broker, which have their own placeholders.
+func renderEnvelope(envelope map[string]any, t time.Time, topic string, record map[string]any) map[string]any {
+	payload := make(map[string]any, len(record))
+	for key, value := range record {
+		switch key {
+		case "time", "session_id", "broker":
+		default:
+			payload[key] = value
+		}
+	}
+	values := map[string]any{
+		"date":       t.Format(time.RFC3339),
+		"topic":      topic,
+		"payload":    payload,
+		"session_id": record["session_id"],
+		"broker":     record["broker"],
+	}
+	return renderTemplate(envelope, values).(map[string]any)
+}
+
+// renderTemplate replaces the placeholders of a template value. A string
+// that is a single placeholder is replaced by the value as is, e.g. the
+// payload object or a number, others are formatted into the string.
+// Placeholders without a value render as null, or as an empty string in a
+// longer string.
+func renderTemplate(value any, values map[string]any) any {
+	switch v := value.(type) {
+	case string:
+		if match := envelopePlaceholder.FindStringSubmatch(v); match != nil && match[0] == v {
+			return placeholderValue(match[1], match[2], values)
+		}
+		return envelopePlaceholder.ReplaceAllStringFunc(v, func(placeholder string) string {
+			match := envelopePlaceholder.FindStringSubmatch(placeholder)
+			value := placeholderValue(match[1], match[2], values)
+			if value == nil {
+				return ""
+			}
+			return fmt.Sprint(value)
+		})
+	case map[string]any:
+		rendered := make(map[string]any, len(v))
+		for key, item := range v {
+			rendered[key] = renderTemplate(item, values)
+		}
+		return rendered
+	case []any:
+		rendered := make([]any, len(v))
+		for i, item := range v {
+			rendered[i] = renderTemplate(item, values)
+		}
+		return rendered
+	default:
+		return v
+	}
+}
+
+// placeholderValue returns the value of a placeholder, nil if it has none
+func placeholderValue(name, sub string, values map[string]any) any {
+	value := values[name]
+	if sub == "" {
+		return value
+	}
+	payload, _ := value.(map[string]any)
+	return payload[sub]
+}
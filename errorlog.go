@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorLog appends messages that could not be parsed to a dedicated file, in
+// the format: <date>|topic=<topic>|error=<error>|payload=<base64 payload>.
+// The file is only created once the first error occurs.
+type ErrorLog struct {
+	mu       sync.Mutex
+	filePath string
+	file     *os.File
+}
+
+// NewErrorLog creates an error log writing to filePath, or a no-op one if filePath is empty
+func NewErrorLog(filePath string) *ErrorLog {
+	return &ErrorLog{
+		filePath: filePath,
+	}
+}
+
+// Record appends an unparseable message along with its parse error
+func (e *ErrorLog) Record(topic string, payload []byte, parseErr error) error {
+	if e.filePath == "" {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		file, err := openOutputFile(e.filePath)
+		if err != nil {
+			return err
+		}
+		e.file = file
+	}
+
+	// Keep the error on a single line and the separator unambiguous
+	message := strings.NewReplacer("\n", " ", "|", "/").Replace(parseErr.Error())
+	line := fmt.Sprintf("%s|topic=%s|error=%s|payload=%s\n",
+		time.Now().Format(time.RFC3339), topic, message, base64.StdEncoding.EncodeToString(payload))
+	if _, err := e.file.WriteString(line); err != nil {
+		return fmt.Errorf("failed to write to errors file: %w", err)
+	}
+
+	return nil
+}
+
+// Close closes the errors file if it was created
+func (e *ErrorLog) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Failover connects to one broker at a time: the primary one first, then
+// the next one each time failAfter connection attempts in a row failed. Paho
+// is only given the primary broker, the connections are redirected to the
+// active one when dialing, so that the failure of an attempt is the one of
+// the active broker.
+type Failover struct {
+	mu        sync.Mutex
+	brokers   []string // host:port of each broker, the primary one first
+	active    int
+	failures  int
+	failAfter int
+	// onConnect is called with the host:port of the broker on every connection
+	onConnect func(string)
+}
+
+// NewFailover creates a failover between brokers, host:port each, the
+// primary one first
+func NewFailover(brokers []string, failAfter int, onConnect func(string)) *Failover {
+	f := &Failover{
+		brokers:   brokers,
+		failAfter: failAfter,
+		onConnect: onConnect,
+	}
+	f.setActiveGauge()
+	return f
+}
+
+// Open returns a connection function opening the connections to the active
+// broker with open, whichever broker is asked for
+func (f *Failover) Open(open mqtt.OpenConnectionFunc) mqtt.OpenConnectionFunc {
+	return func(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+		f.mu.Lock()
+		active := *uri
+		active.Host = f.brokers[f.active]
+		f.mu.Unlock()
+
+		return open(&active, options)
+	}
+}
+
+// Notify follows the connection attempts: it switches to the next broker
+// once failAfter attempts in a row failed, and logs which broker is
+// connected to
+func (f *Failover) Notify(client mqtt.Client, notification mqtt.ConnectionNotification) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch n := notification.(type) {
+	case mqtt.ConnectionNotificationConnected:
+		f.failures = 0
+		log.Printf("Active broker: %s", f.brokers[f.active])
+		if f.onConnect != nil {
+			f.onConnect(f.brokers[f.active])
+		}
+	case mqtt.ConnectionNotificationFailed:
+		f.failures++
+		if f.failures < f.failAfter {
+			return
+		}
+		from := f.brokers[f.active]
+		f.active = (f.active + 1) % len(f.brokers)
+		f.failures = 0
+		brokerFailovers.Inc()
+		f.setActiveGauge()
+		log.Printf("Failing over from broker %s to %s after %d failed connection attempts: %v", from, f.brokers[f.active], f.failAfter, n.Reason)
+	}
+}
+
+// setActiveGauge exposes the active broker. The caller must hold f.mu
+// or own f.
+func (f *Failover) setActiveGauge() {
+	for i, broker := range f.brokers {
+		value := 0.0
+		if i == f.active {
+			value = 1
+		}
+		activeBroker.WithLabelValues(broker).Set(value)
+	}
+}
+
+// failoverBrokers returns the host:port of the primary broker followed by
+// the failover ones, which default to the port of the primary one
+func failoverBrokers(primary string, port int, failover []string) ([]string, error) {
+	brokers := []string{net.JoinHostPort(primary, fmt.Sprint(port))}
+	for _, broker := range failover {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, fmt.Sprint(port))
+		}
+		for _, b := range brokers {
+			if b == broker {
+				return nil, fmt.Errorf("mqtt.failover_brokers lists %s twice", broker)
+			}
+		}
+		brokers = append(brokers, broker)
+	}
+	return brokers, nil
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policies applied when a payload doesn't have the expected shape
+const (
+	shapeMismatchRecord = "record"
+	shapeMismatchDrop   = "drop"
+	shapeMismatchFlag   = "flag"
+)
+
+// Ways of writing the output fields missing from a payload
+const (
+	missingFieldOmit  = "omit"
+	missingFieldNull  = "null"
+	missingFieldEmpty = "empty"
+)
+
+// Policies applied when a renamed field collides with another field
+const (
+	renameCollisionError     = "error"
+	renameCollisionFirstWins = "first-wins"
+	renameCollisionLastWins  = "last-wins"
+	renameCollisionSuffix    = "suffix"
+)
+
+// Policies applied to topics and payload strings holding control characters
+const (
+	controlCharsAllow    = "allow"
+	controlCharsSanitize = "sanitize"
+	controlCharsReject   = "reject"
+)
+
+// Types expected for output fields
+const (
+	fieldTypeNumber = "number"
+	fieldTypeString = "string"
+	fieldTypeBool   = "bool"
+)
+
+// Policies applied when an output field doesn't have its expected type
+const (
+	typeMismatchRecord = "record"
+	typeMismatchFlag   = "flag"
+	typeMismatchDrop   = "drop"
+	typeMismatchCoerce = "coerce"
+)
+
+// Cases payload keys are normalized to
+const (
+	normalizeKeysLower = "lower"
+	normalizeKeysUpper = "upper"
+	normalizeKeysSnake = "snake"
+)
+
+// When payload keys are normalized, relative to rename_fields
+const (
+	normalizeBeforeRename = "before-rename"
+	normalizeAfterRename  = "after-rename"
+)
+
+// Ways of promoting nested fields to the top level of a payload
+const (
+	promoteModeCopy = "copy"
+	promoteModeMove = "move"
+)
+
+// FieldRename renames a payload field
+type FieldRename struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+// renameFields renames the payload fields, in the order of the renames. A
+// field renamed to a key already present collides with it: the fields kept
+// as is come first, then the renamed ones in order, and policy decides which
+// value is kept. The collisions are returned, or an error with the error policy.
+func renameFields(payload map[string]any, renames []FieldRename, policy string) (map[string]any, []string, error) {
+	renamed := make(map[string]any, len(payload))
+	for key, value := range payload {
+		renamed[key] = value
+	}
+	for _, r := range renames {
+		delete(renamed, r.From)
+	}
+
+	var collisions []string
+	for _, r := range renames {
+		value, ok := payload[r.From]
+		if !ok {
+			continue
+		}
+		if _, exists := renamed[r.To]; !exists {
+			renamed[r.To] = value
+			continue
+		}
+
+		collision := fmt.Sprintf("%s renamed to existing field %s", r.From, r.To)
+		switch policy {
+		case renameCollisionError:
+			return nil, nil, fmt.Errorf("rename collision: %s", collision)
+		case renameCollisionFirstWins:
+		case renameCollisionLastWins:
+			renamed[r.To] = value
+		case renameCollisionSuffix:
+			key := suffixedKey(renamed, r.To)
+			renamed[key] = value
+			collision += ", kept as " + key
+		}
+		collisions = append(collisions, collision)
+	}
+
+	return renamed, collisions, nil
+}
+
+// normalizeKeys normalizes the case of the top-level payload keys. Keys
+// normalizing to the same key collide, and policy decides which value is kept
+// as with renameFields, considering the keys already normalized first, then
+// the others in sorted order. The collisions are returned, or an error with
+// the error policy.
+func normalizeKeys(payload map[string]any, mode, policy string) (map[string]any, []string, error) {
+	normalized := make(map[string]any, len(payload))
+	var others []string
+	for key, value := range payload {
+		if normalizeKey(key, mode) == key {
+			normalized[key] = value
+		} else {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+
+	var collisions []string
+	for _, key := range others {
+		value := payload[key]
+		to := normalizeKey(key, mode)
+		if _, exists := normalized[to]; !exists {
+			normalized[to] = value
+			continue
+		}
+
+		collision := fmt.Sprintf("%s normalized to existing field %s", key, to)
+		switch policy {
+		case renameCollisionError:
+			return nil, nil, fmt.Errorf("normalize collision: %s", collision)
+		case renameCollisionFirstWins:
+		case renameCollisionLastWins:
+			normalized[to] = value
+		case renameCollisionSuffix:
+			suffixed := suffixedKey(normalized, to)
+			normalized[suffixed] = value
+			collision += ", kept as " + suffixed
+		}
+		collisions = append(collisions, collision)
+	}
+
+	return normalized, collisions, nil
+}
+
+// normalizeKey converts a key to lower or upper case, or to snake case:
+// batteryLevel, BatteryLevel and battery-level all become battery_level, and
+// HTTPStatus http_status
+func normalizeKey(key, mode string) string {
+	switch mode {
+	case normalizeKeysLower:
+		return strings.ToLower(key)
+	case normalizeKeysUpper:
+		return strings.ToUpper(key)
+	}
+
+	runes := []rune(key)
+	var snake []rune
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == ' ':
+			snake = append(snake, '_')
+		case unicode.IsUpper(r):
+			// A word starts at an uppercase letter following a lowercase
+			// letter or a digit, or ending an acronym before a lowercase one
+			if i > 0 && len(snake) > 0 && snake[len(snake)-1] != '_' {
+				prev := runes[i-1]
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+					unicode.IsUpper(prev) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) {
+					snake = append(snake, '_')
+				}
+			}
+			snake = append(snake, unicode.ToLower(r))
+		default:
+			snake = append(snake, r)
+		}
+	}
+	return string(snake)
+}
+
+// suffixedKey returns the first of key_2, key_3... not present in fields
+func suffixedKey(fields map[string]any, key string) string {
+	for i := 2; ; i++ {
+		suffixed := fmt.Sprintf("%s_%d", key, i)
+		if _, exists := fields[suffixed]; !exists {
+			return suffixed
+		}
+	}
+}
+
+// promotedKey returns the top-level key a nested field is promoted to, its
+// path with the dots replaced by underscores: device.id is promoted to device_id
+func promotedKey(path string) string {
+	return strings.ReplaceAll(path, ".", "_")
+}
+
+// promoteFields copies the nested fields at the dotted paths to the top level
+// of the payload, or moves them if move is set. A promoted field colliding
+// with a top-level field is handled as with renameFields, the top-level field
+// coming first. The collisions are returned, or an error with the error policy.
+func promoteFields(payload map[string]any, paths []string, move bool, policy string) (map[string]any, []string, error) {
+	promoted := make(map[string]any, len(payload)+len(paths))
+	for key, value := range payload {
+		promoted[key] = value
+	}
+
+	var collisions []string
+	for _, path := range paths {
+		parent, leaf, ok := nestedParent(promoted, path)
+		if !ok {
+			continue
+		}
+		value, ok := parent[leaf]
+		if !ok {
+			continue
+		}
+		if move {
+			delete(parent, leaf)
+		}
+
+		key := promotedKey(path)
+		if _, exists := promoted[key]; !exists {
+			promoted[key] = value
+			continue
+		}
+
+		collision := fmt.Sprintf("%s promoted to existing field %s", path, key)
+		switch policy {
+		case renameCollisionError:
+			return nil, nil, fmt.Errorf("promote collision: %s", collision)
+		case renameCollisionFirstWins:
+		case renameCollisionLastWins:
+			promoted[key] = value
+		case renameCollisionSuffix:
+			suffixed := suffixedKey(promoted, key)
+			promoted[suffixed] = value
+			collision += ", kept as " + suffixed
+		}
+		collisions = append(collisions, collision)
+	}
+
+	return promoted, collisions, nil
+}
+
+// nestedParent returns the object holding the last element of a dotted path
+// and the name of that element, e.g. payload["device"] and "id" for device.id.
+// The objects along the path are copied, so moving a field out of them leaves
+// the original payload untouched.
+func nestedParent(payload map[string]any, path string) (map[string]any, string, bool) {
+	parts := strings.Split(path, ".")
+	parent := payload
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := parent[part].(map[string]any)
+		if !ok {
+			return nil, "", false
+		}
+		copied := make(map[string]any, len(child))
+		for key, value := range child {
+			copied[key] = value
+		}
+		parent[part] = copied
+		parent = copied
+	}
+	return parent, parts[len(parts)-1], true
+}
+
+// payloadField returns the value of a payload field, nested ones given as a
+// dotted path (device.id), unless a top-level key holds the whole path
+func payloadField(payload map[string]any, path string) (any, bool) {
+	if value, ok := payload[path]; ok {
+		return value, true
+	}
+	parts := strings.Split(path, ".")
+	object := payload
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := object[part].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		object = child
+	}
+	value, ok := object[parts[len(parts)-1]]
+	return value, ok
+}
+
+// payloadFieldFold returns the value of a payload field as payloadField
+// does, the keys falling back to a case-insensitive match
+func payloadFieldFold(payload map[string]any, path string) (any, bool) {
+	if value, ok := payloadField(payload, path); ok {
+		return value, true
+	}
+	lookup := func(object map[string]any, key string) (any, bool) {
+		for k, value := range object {
+			if strings.EqualFold(k, key) {
+				return value, true
+			}
+		}
+		return nil, false
+	}
+	if value, ok := lookup(payload, path); ok {
+		return value, true
+	}
+	parts := strings.Split(path, ".")
+	object := payload
+	for _, part := range parts[:len(parts)-1] {
+		value, _ := lookup(object, part)
+		child, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		object = child
+	}
+	return lookup(object, parts[len(parts)-1])
+}
+
+// fieldPattern is a regular expression a payload field must match
+type fieldPattern struct {
+	Path    string
+	Pattern *regexp.Regexp
+}
+
+// compileFieldMatch compiles the field_match patterns, in path order. Dotted
+// paths are read as nested keys from the configuration, so nested maps are
+// joined back into paths.
+func compileFieldMatch(patterns map[string]any) ([]fieldPattern, error) {
+	var compiled []fieldPattern
+	var walk func(prefix string, patterns map[string]any) error
+	walk = func(prefix string, patterns map[string]any) error {
+		for key, value := range patterns {
+			path := prefix + key
+			switch v := value.(type) {
+			case string:
+				re, err := regexp.Compile(v)
+				if err != nil {
+					return fmt.Errorf("failed to compile field_match.%s: %w", path, err)
+				}
+				compiled = append(compiled, fieldPattern{Path: path, Pattern: re})
+			case map[string]any:
+				if err := walk(path+".", v); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("field_match.%s must be a regular expression", path)
+			}
+		}
+		return nil
+	}
+	if err := walk("", patterns); err != nil {
+		return nil, err
+	}
+	sort.Slice(compiled, func(i, j int) bool { return compiled[i].Path < compiled[j].Path })
+	return compiled, nil
+}
+
+// matchFields reports whether every field of patterns is in the payload and
+// matches its pattern: strings as is, numbers and booleans as written in
+// JSON. Objects, arrays and nulls never match.
+func matchFields(payload map[string]any, patterns []fieldPattern) bool {
+	for _, p := range patterns {
+		value, _ := payloadFieldFold(payload, p.Path)
+		var text string
+		switch v := value.(type) {
+		case string:
+			text = v
+		case float64:
+			text = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			text = strconv.FormatBool(v)
+		default:
+			return false
+		}
+		if !p.Pattern.MatchString(text) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectFields returns the output fields present in a payload
+func selectFields(payload map[string]any, fields []string) map[string]any {
+	selected := make(map[string]any, len(fields))
+	for _, name := range fields {
+		if value, ok := payload[name]; ok {
+			selected[name] = value
+		}
+	}
+	return selected
+}
+
+// hasType reports whether a payload value is of the expected field type
+func hasType(value any, typ string) bool {
+	switch typ {
+	case fieldTypeNumber:
+		_, ok := value.(float64)
+		return ok
+	case fieldTypeString:
+		_, ok := value.(string)
+		return ok
+	case fieldTypeBool:
+		_, ok := value.(bool)
+		return ok
+	}
+	return true
+}
+
+// coerceType converts a payload value to the expected field type, e.g. the
+// string "-65" to a number, reporting whether it could
+func coerceType(value any, typ string) (any, bool) {
+	switch typ {
+	case fieldTypeNumber:
+		if s, ok := value.(string); ok {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+				return f, true
+			}
+		}
+	case fieldTypeString:
+		switch v := value.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case fieldTypeBool:
+		if s, ok := value.(string); ok {
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				return b, true
+			}
+		}
+	}
+	return value, false
+}
+
+// checkFieldTypes checks the fields of a payload against their expected
+// type, returning the mismatching ones in sorted order. With coerce, the
+// mismatching values are converted when possible, in a copy of the payload,
+// and only those that can't be are returned. Absent and null fields are not
+// checked.
+func checkFieldTypes(payload map[string]any, types map[string]string, coerce bool) (map[string]any, []string) {
+	var mismatches []string
+	checked, copied := payload, false
+	for name, typ := range types {
+		value, ok := payload[name]
+		if !ok || value == nil || hasType(value, typ) {
+			continue
+		}
+		if coerce {
+			if coerced, ok := coerceType(value, typ); ok {
+				if !copied {
+					checked = make(map[string]any, len(payload))
+					for key, value := range payload {
+						checked[key] = value
+					}
+					copied = true
+				}
+				checked[name] = coerced
+				continue
+			}
+		}
+		mismatches = append(mismatches, name)
+	}
+	sort.Strings(mismatches)
+	return checked, mismatches
+}
+
+// roundFloats rounds the numbers of a payload value to precision decimal
+// places, descending into objects and arrays. Integers and non-numeric
+// values are left untouched.
+func roundFloats(value any, precision int) any {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return v
+		}
+		// Formatting rounds to the nearest decimal, unlike scaling by a power
+		// of ten which adds its own representation errors
+		rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', precision, 64), 64)
+		if err != nil {
+			return v
+		}
+		return rounded
+	case map[string]any:
+		rounded := make(map[string]any, len(v))
+		for key, item := range v {
+			rounded[key] = roundFloats(item, precision)
+		}
+		return rounded
+	case []any:
+		rounded := make([]any, len(v))
+		for i, item := range v {
+			rounded[i] = roundFloats(item, precision)
+		}
+		return rounded
+	default:
+		return v
+	}
+}
+
+// truncateKeys keeps the first max keys of a payload in sorted order, so the
+// same payload is always truncated the same way. It reports whether keys
+// were removed.
+func truncateKeys(payload map[string]any, max int) (map[string]any, bool) {
+	if len(payload) <= max {
+		return payload, false
+	}
+
+	keys := make([]string, 0, len(payload))
+	for key := range payload {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	truncated := make(map[string]any, max)
+	for _, key := range keys[:max] {
+		truncated[key] = payload[key]
+	}
+	return truncated, true
+}
+
+// truncationMarker ends the strings shortened by max_field_length
+const truncationMarker = "…"
+
+// truncateFields shortens the strings of a payload longer than max
+// characters, nested ones included, those of top-level fields listed in
+// lengths (by lowercase name) to their own limit, 0 for none. It returns the
+// number of strings shortened.
+func truncateFields(payload map[string]any, max int, lengths map[string]int) (map[string]any, int) {
+	if payload == nil {
+		return nil, 0
+	}
+	truncated := make(map[string]any, len(payload))
+	count := 0
+	for key, value := range payload {
+		limit, ok := lengths[strings.ToLower(key)]
+		if !ok {
+			limit = max
+		}
+		var n int
+		truncated[key], n = truncateStrings(value, limit)
+		count += n
+	}
+	return truncated, count
+}
+
+// truncateStrings shortens the strings of a value longer than max
+// characters, unless max is 0, followed by the truncation marker. It returns
+// the number of strings shortened.
+func truncateStrings(value any, max int) (any, int) {
+	if max <= 0 {
+		return value, 0
+	}
+	switch v := value.(type) {
+	case string:
+		if utf8.RuneCountInString(v) <= max {
+			return v, 0
+		}
+		end := 0
+		for i := 0; i < max; i++ {
+			_, size := utf8.DecodeRuneInString(v[end:])
+			end += size
+		}
+		return v[:end] + truncationMarker, 1
+	case map[string]any:
+		truncated := make(map[string]any, len(v))
+		count := 0
+		for key, item := range v {
+			var n int
+			truncated[key], n = truncateStrings(item, max)
+			count += n
+		}
+		return truncated, count
+	case []any:
+		truncated := make([]any, len(v))
+		count := 0
+		for i, item := range v {
+			var n int
+			truncated[i], n = truncateStrings(item, max)
+			count += n
+		}
+		return truncated, count
+	default:
+		return value, 0
+	}
+}
+
+// hasControlChars reports whether s holds a control character, such as a
+// null byte or a newline
+func hasControlChars(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+// containsControlChars reports whether a payload value holds a string, or an
+// object key, with a control character
+func containsControlChars(value any) bool {
+	switch v := value.(type) {
+	case string:
+		return hasControlChars(v)
+	case map[string]any:
+		for key, item := range v {
+			if hasControlChars(key) || containsControlChars(item) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if containsControlChars(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sanitizeControlChars replaces the control characters of s with their Go
+// escape sequence, e.g. a newline with \n and a null byte with \x00
+func sanitizeControlChars(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !unicode.IsControl(r) {
+			b.WriteRune(r)
+			continue
+		}
+		quoted := strconv.QuoteRune(r)
+		b.WriteString(quoted[1 : len(quoted)-1])
+	}
+	return b.String()
+}
+
+// sanitizeValue sanitizes the strings and object keys of a payload value
+func sanitizeValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return sanitizeControlChars(v)
+	case map[string]any:
+		sanitized := make(map[string]any, len(v))
+		for key, item := range v {
+			sanitized[sanitizeControlChars(key)] = sanitizeValue(item)
+		}
+		return sanitized
+	case []any:
+		sanitized := make([]any, len(v))
+		for i, item := range v {
+			sanitized[i] = sanitizeValue(item)
+		}
+		return sanitized
+	default:
+		return v
+	}
+}
+
+// payloadType returns the JSON type of a decoded payload: object, array,
+// number, string, bool or null
+func payloadType(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	}
+	return "null"
+}
+
+// shapeID fingerprints the key structure of a payload: the first 8 bytes of
+// the SHA-256 of its sorted key paths, nested objects included as dotted
+// paths, in hex. Payloads with the same keys have the same shape whatever
+// their values, and arrays count as values.
+func shapeID(payload map[string]any) string {
+	paths := keyPaths(payload, "", nil)
+	sort.Strings(paths)
+	sum := sha256.Sum256([]byte(strings.Join(paths, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// keyPaths appends the dotted paths of the keys of an object to paths
+func keyPaths(object map[string]any, prefix string, paths []string) []string {
+	for key, value := range object {
+		path := prefix + key
+		paths = append(paths, path)
+		if nested, ok := value.(map[string]any); ok {
+			paths = keyPaths(nested, path+".", paths)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// groupedEventsKey is the key events are grouped under with the grouped format
+const groupedEventsKey = "_events"
+
+// groupByTopic is the group_by value grouping the records by topic
+const groupByTopic = "topic"
+
+// loadGrouped reads the records already in a grouped output file, so a run
+// appends to them instead of overwriting them
+func loadGrouped(file *os.File) (map[string][]map[string]any, error) {
+	groups := make(map[string][]map[string]any)
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+	if len(data) == 0 {
+		return groups, nil
+	}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("output file %s is not a grouped JSON file: %w", file.Name(), err)
+	}
+	return groups, nil
+}
+
+// encodeRecords encodes records to JSON followed by a newline, indented with
+// indent if not empty. Unless escapeHTML is set, <, > and & are written as is
+// instead of as \u003c, \u003e and \u0026.
+func encodeRecords(v any, indent string, escapeHTML bool) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(escapeHTML)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// groupedRecord builds the JSON object of a record, with its time and the
+// trailer fields
+func (fw *FileWriter) groupedRecord(t time.Time, fields []field) map[string]any {
+	record := map[string]any{"time": t.Format(time.RFC3339)}
+	for _, f := range fields {
+		record[f.key] = f.value
+	}
+	if fw.sessionID != "" {
+		record["session_id"] = fw.sessionID
+	}
+	if broker := fw.brokerLabel(); broker != "" {
+		record["broker"] = broker
+	}
+	if fw.monotonicField != "" {
+		record[fw.monotonicField] = time.Since(fw.start).Seconds()
+	}
+	return record
+}
+
+// messageRecord builds the record of a message for the grouped and msgpack
+// formats and the state file: its grouped record, in the shape of the
+// envelope if any
+func (fw *FileWriter) messageRecord(t time.Time, topic string, fields []field) map[string]any {
+	record := fw.groupedRecord(t, fields)
+	if fw.envelope == nil {
+		return record
+	}
+	return renderEnvelope(fw.envelope, t, topic, record)
+}
+
+// groupKey returns the key the record of a message is grouped under: its
+// topic, or the value of the groupBy payload field. Records without it, or
+// with an object, array or empty value, go under groupDefault.
+func (fw *FileWriter) groupKey(topic string, payload map[string]any) string {
+	if fw.groupBy == groupByTopic {
+		return topic
+	}
+	value, _ := payloadField(payload, fw.groupBy)
+	switch v := value.(type) {
+	case string:
+		if v != "" {
+			return v
+		}
+	case float64, bool:
+		return fmt.Sprint(v)
+	}
+	return fw.groupDefault
+}
+
+// groupMessage adds the record of a message to its group. Grouped by a
+// payload field, records carry their topic, unless shaped by an envelope.
+func (fw *FileWriter) groupMessage(topic string, payload, record map[string]any) {
+	if fw.groupBy != groupByTopic && fw.envelope == nil {
+		record["topic"] = topic
+	}
+	fw.group(fw.groupKey(topic, payload), record)
+}
+
+// group adds a record to the group of key, it is written on the next flush
+func (fw *FileWriter) group(key string, record map[string]any) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	fw.groups[key] = append(fw.groups[key], record)
+	fw.dirty = true
+}
+
+// writeGrouped rewrites the output file with all the records grouped, if any was added since the last write. The caller must hold fw.mu.
+func (fw *FileWriter) writeGrouped() (err error) {
+	if !fw.dirty {
+		return nil
+	}
+	defer func() {
+		fw.accountWrite(err)
+	}()
+
+	data, err := fw.encodeJSON(fw.groups, "")
+	if err != nil {
+		return fmt.Errorf("failed to encode records: %w", err)
+	}
+
+	// The file is replaced atomically, so readers never see a partially
+	// written file and a crash leaves the last complete version
+	path := fw.file.Name()
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write to file: %w", err)
+	}
+
+	// Reopen the file, the previous one was replaced
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to reopen output file: %w", err)
+	}
+	fw.file.Close()
+	fw.file = file
+
+	fw.dirty = false
+	return nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// grpcMethod is the client-streaming RPC of record.proto records are sent to
+const grpcMethod = "/mqtttrace.v1.Recorder/Stream"
+
+const (
+	// Bounds of the wait between two stream attempts, doubling each time
+	grpcMinBackoff = time.Second
+	grpcMaxBackoff = 30 * time.Second
+	// grpcCloseTimeout bounds the wait for the server to acknowledge the end
+	// of the stream when stopping
+	grpcCloseTimeout = 5 * time.Second
+)
+
+// GRPCConfig streams the records to a gRPC server
+type GRPCConfig struct {
+	// Endpoint is the host:port of the server, disabled when empty
+	Endpoint string `mapstructure:"endpoint"`
+	// Buffer is the number of records held while the stream is down or
+	// slow, the next ones being dropped
+	Buffer int `mapstructure:"buffer"`
+	TLS    struct {
+		Enabled            bool   `mapstructure:"enabled"`
+		CAFile             string `mapstructure:"ca_file"`
+		CertFile           string `mapstructure:"cert_file"`
+		KeyFile            string `mapstructure:"key_file"`
+		ServerName         string `mapstructure:"server_name"`
+		InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+	} `mapstructure:"tls"`
+}
+
+// rawCodec sends messages already encoded as protobuf, keeping the proto
+// content type servers expect
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	out, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*out = append((*out)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// grpcRecord encodes a Record of record.proto
+func grpcRecord(topic string, t time.Time, payload []byte, binary bool, sessionID, broker string) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, topic)
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(t.UnixNano()))
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, payload)
+	if binary {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	if sessionID != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, sessionID)
+	}
+	if broker != "" {
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendString(b, broker)
+	}
+	return b
+}
+
+// forwardMessage queues a message record for the gRPC stream, its fields as
+// a JSON object
+func (fw *FileWriter) forwardMessage(topic string, t time.Time, fields []field) {
+	object := make(map[string]any, len(fields))
+	for _, f := range fields {
+		object[f.key] = f.value
+	}
+	payload, err := json.Marshal(object)
+	if err != nil {
+		log.Printf("Error encoding record of %s for gRPC: %v", topic, err)
+		return
+	}
+	fw.grpc.Send(grpcRecord(topic, t, payload, false, fw.sessionID, fw.brokerLabel()))
+}
+
+// GRPCForwarder streams records to a gRPC server from a buffer, in the
+// background: a failed stream is reopened with a growing backoff, the record
+// it failed on sent again, and the records are dropped once the buffer is
+// full, so the capture never waits for the server
+type GRPCForwarder struct {
+	conn     *grpc.ClientConn
+	endpoint string
+	queue    chan []byte
+	done     chan struct{}
+	wg       sync.WaitGroup
+	// overflowing is set from the first dropped record until one is queued
+	// again, so each overflow is logged once
+	overflowing atomic.Bool
+}
+
+// NewGRPCForwarder creates a forwarder to the configured server and starts
+// streaming. Connections are made lazily, an unreachable server is retried.
+func NewGRPCForwarder(config GRPCConfig) (*GRPCForwarder, error) {
+	creds := insecure.NewCredentials()
+	if config.TLS.Enabled {
+		tlsConfig, err := newGRPCTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(config.Endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %w", err)
+	}
+
+	f := &GRPCForwarder{
+		conn:     conn,
+		endpoint: config.Endpoint,
+		queue:    make(chan []byte, config.Buffer),
+		done:     make(chan struct{}),
+	}
+	f.wg.Add(1)
+	go f.run()
+	return f, nil
+}
+
+// newGRPCTLSConfig builds the TLS configuration used to connect to the server
+func newGRPCTLSConfig(config GRPCConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.TLS.ServerName,
+		InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.TLS.CAFile != "" {
+		pool, err := newCertPool(false)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := os.ReadFile(config.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gRPC CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificate found in gRPC CA file %s", config.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load gRPC client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Send queues an encoded record, dropping it if the buffer is full
+func (f *GRPCForwarder) Send(record []byte) {
+	select {
+	case f.queue <- record:
+		f.overflowing.Store(false)
+	default:
+		grpcDropped.Inc()
+		if !f.overflowing.Swap(true) {
+			log.Printf("gRPC buffer full, dropping records until %s catches up", f.endpoint)
+		}
+	}
+}
+
+// run streams the queued records, reopening the stream when it fails
+func (f *GRPCForwarder) run() {
+	defer f.wg.Done()
+
+	backoff := grpcMinBackoff
+	var pending []byte
+	for {
+		err := f.stream(&pending, func() { backoff = grpcMinBackoff })
+		if err == nil {
+			return
+		}
+		grpcStreamErrors.Inc()
+
+		select {
+		case <-f.done:
+			log.Printf("Error streaming records to %s: %v", f.endpoint, err)
+			f.logLost(pending)
+			return
+		default:
+		}
+		log.Printf("Error streaming records to %s, retrying in %s: %v", f.endpoint, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-f.done:
+			f.logLost(pending)
+			return
+		}
+		backoff = min(2*backoff, grpcMaxBackoff)
+	}
+}
+
+// logLost logs the number of records left unsent when stopping
+func (f *GRPCForwarder) logLost(pending []byte) {
+	lost := len(f.queue)
+	if pending != nil {
+		lost++
+	}
+	if lost > 0 {
+		log.Printf("Stopping with %d records not streamed to %s", lost, f.endpoint)
+	}
+}
+
+// stream opens a stream and sends the pending record, if any, then the
+// queued ones. A record that fails to be sent is left pending. It returns nil
+// once stopped and the stream closed cleanly.
+func (f *GRPCForwarder) stream(pending *[]byte, opened func()) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	desc := &grpc.StreamDesc{StreamName: "Stream", ClientStreams: true}
+	stream, err := f.conn.NewStream(ctx, desc, grpcMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+	opened()
+
+	send := func(record []byte) error {
+		if err := stream.SendMsg(record); err != nil {
+			*pending = record
+			return streamError(stream, err)
+		}
+		*pending = nil
+		grpcSent.Inc()
+		return nil
+	}
+	if *pending != nil {
+		if err := send(*pending); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case record := <-f.queue:
+			if err := send(record); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			// The server ended the stream, no record being sent to tell
+			return streamError(stream, io.EOF)
+		case <-f.done:
+			// Flush what is left, then wait for the server to acknowledge
+			for len(f.queue) > 0 {
+				if err := send(<-f.queue); err != nil {
+					return err
+				}
+			}
+			timer := time.AfterFunc(grpcCloseTimeout, cancel)
+			defer timer.Stop()
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			var summary []byte
+			return stream.RecvMsg(&summary)
+		}
+	}
+}
+
+// streamError returns why a stream failed: when sending fails with io.EOF,
+// the status of the stream is only known by receiving from it
+func streamError(stream grpc.ClientStream, err error) error {
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+	var summary []byte
+	if err := stream.RecvMsg(&summary); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by the server")
+}
+
+// Close streams the records left in the buffer and closes the stream, or
+// gives up if the stream is down
+func (f *GRPCForwarder) Close() error {
+	close(f.done)
+	f.wg.Wait()
+	return f.conn.Close()
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/expr-lang/expr"
+)
+
+// Handler processes the messages received on the subscriptions
+type Handler struct {
+	config   *Config
+	writer   *FileWriter
+	drops    *DropLog
+	errors   *ErrorLog
+	jitter   *JitterStats
+	quality  *QualityScore
+	distinct *DistinctPayloads
+	catchUp  *CatchUp
+	sampler  *Sampler
+	// filters can be swapped while messages are handled
+	filters atomic.Pointer[Filters]
+	// thresholds is nil when no threshold is configured
+	thresholds *ThresholdMonitor
+	// schedule is nil when messages are recorded at all times
+	schedule *Schedule
+	// counts is nil without a summary file
+	counts *SubscriptionCounts
+	// identity is nil without a dedup_field
+	identity *IdentityDedup
+	// baseline is nil without a baseline.file
+	baseline *Baseline
+
+	// inflight is the number of messages being handled, handled the number
+	// of messages handled so far, to drain them on shutdown
+	inflight atomic.Int64
+	handled  atomic.Uint64
+}
+
+// NewHandler creates a message handler, compiling the transform expression if any
+func NewHandler(config *Config, writer *FileWriter, drops *DropLog, errors *ErrorLog, jitter *JitterStats, distinct *DistinctPayloads, catchUp *CatchUp, quality *QualityScore, counts *SubscriptionCounts, baseline *Baseline) (*Handler, error) {
+	h := &Handler{
+		config:   config,
+		writer:   writer,
+		drops:    drops,
+		errors:   errors,
+		jitter:   jitter,
+		quality:  quality,
+		counts:   counts,
+		baseline: baseline,
+		distinct: distinct,
+		catchUp:  catchUp,
+		sampler:  NewSampler(config.MQTT.Topics, config.SampleSeed),
+	}
+
+	if len(config.Thresholds) > 0 {
+		h.thresholds = NewThresholdMonitor(config.Thresholds, config.MaxTrackedTopics)
+	}
+
+	if len(config.Schedule.Windows) > 0 {
+		h.schedule = NewSchedule(config.Schedule.Windows, config.Schedule.Location)
+	}
+
+	if config.DedupField != "" {
+		h.identity = NewIdentityDedup(config.DedupField, config.DedupLRUSize)
+	}
+
+	filters, err := newFilters(config)
+	if err != nil {
+		return nil, err
+	}
+	h.SetFilters(filters)
+
+	return h, nil
+}
+
+// SetFilters applies filters to the next messages
+func (h *Handler) SetFilters(filters *Filters) {
+	h.filters.Store(filters)
+}
+
+// transformEnv is the environment the transform expression is evaluated in
+type transformEnv struct {
+	Topic   string `expr:"topic"`
+	Payload any    `expr:"payload"`
+}
+
+// HandleMessage handles incoming MQTT messages
+func (h *Handler) HandleMessage(client mqtt.Client, msg mqtt.Message) {
+	h.inflight.Add(1)
+	defer func() {
+		h.handled.Add(1)
+		h.inflight.Add(-1)
+	}()
+
+	// With manual acknowledgments, dropped messages are acknowledged right
+	// away and recorded ones once written
+	deferredAck := false
+	if h.config.MQTT.ManualAck {
+		defer func() {
+			if !deferredAck {
+				msg.Ack()
+			}
+		}()
+	}
+
+	// The filters of a message stay the same if they are reloaded meanwhile
+	filters := h.filters.Load()
+
+	// Control characters in topics or payload strings can corrupt the output
+	topic := msg.Topic()
+	if h.config.ControlChars != controlCharsAllow && hasControlChars(topic) {
+		if h.config.ControlChars == controlCharsReject {
+			log.Printf("Dropping message on topic %q: control characters in topic", topic)
+			h.drops.Drop(sanitizeControlChars(topic), dropControlChars)
+			return
+		}
+		topic = sanitizeControlChars(topic)
+	}
+
+	received := time.Now()
+	if h.schedule != nil && !h.schedule.Active(received) {
+		h.drops.Drop(topic, dropOutOfSchedule)
+		return
+	}
+	if h.jitter != nil {
+		h.jitter.Observe(topic, received)
+	}
+	if h.quality != nil {
+		h.quality.Observe(topic, received)
+	}
+	catchingUp := h.catchUp != nil && h.catchUp.Observe(received)
+
+	// Paused messages still count in the statistics above
+	if h.writer.Paused() {
+		h.drops.Drop(topic, dropPaused)
+		return
+	}
+
+	if h.distinct != nil && h.distinct.Seen(topic, msg.Payload()) {
+		h.drops.Drop(topic, dropRepeatedPayload)
+		return
+	}
+
+	if !h.sampler.Keep(topic) {
+		h.drops.Drop(topic, dropSampledOut)
+		return
+	}
+
+	// Only QoS 1/2 messages are redelivered, QoS 0 ones have no packet ID
+	if h.config.DedupRedelivered && msg.Qos() > 0 && h.writer.Redelivered(redeliveryKey(msg)) {
+		log.Printf("Dropping redelivered message on topic %s (packet %d)", topic, msg.MessageID())
+		h.drops.Drop(topic, dropDuplicate)
+		return
+	}
+
+	// Binary topics are never valid JSON, don't even try
+	if matchesAny(h.config.BinaryTopics, topic) {
+		if err := h.writer.WriteBinary(topic, msg.Payload()); err != nil {
+			log.Printf("Error saving message: %v", err)
+			h.drops.Drop(topic, dropWriteError)
+			return
+		}
+		if h.counts != nil {
+			h.counts.Observe(topic)
+		}
+		if h.config.MQTT.ManualAck {
+			h.writer.AckWhenWritten(msg.Ack)
+			deferredAck = true
+		}
+		log.Printf("Received binary message on topic %s", topic)
+		return
+	}
+
+	var value any
+	if err := json.Unmarshal(msg.Payload(), &value); err != nil {
+		log.Printf("Error unmarshaling message from topic %s: %v", topic, err)
+		h.drops.Drop(topic, dropParseError)
+		if err := h.errors.Record(topic, msg.Payload(), err); err != nil {
+			log.Printf("Error saving unparseable message: %v", err)
+		}
+		return
+	}
+
+	// Some gateways publish JSON encoded as a JSON string, unwrap it once
+	unwrapped := false
+	if s, ok := value.(string); ok && h.config.UnwrapJSONString {
+		var inner any
+		if err := json.Unmarshal([]byte(s), &inner); err == nil {
+			value = inner
+			unwrapped = true
+		}
+	}
+
+	// The type is the one received, once unwrapped, before any transform
+	var valueType string
+	if h.config.IncludePayloadType {
+		valueType = payloadType(value)
+	}
+
+	// The checksum covers the payload as sent, before it is changed
+	var checksumFailure string
+	if c := h.config.Checksum; c.Field != "" && (len(c.Topics) == 0 || matchesAny(c.Topics, topic)) {
+		payload, _ := value.(map[string]any)
+		if checksumFailure = verifyChecksum(payload, c); checksumFailure != "" {
+			checksumFailures.WithLabelValues(checksumFailure).Inc()
+			if c.OnFailure == checksumFailureDrop {
+				log.Printf("Dropping message on topic %s: checksum %s", topic, checksumFailure)
+				h.drops.Drop(topic, dropChecksum)
+				return
+			}
+			log.Printf("Checksum %s on topic %s", checksumFailure, topic)
+		}
+	}
+
+	// The identity is the one sent, before any transform
+	if h.identity != nil {
+		if payload, ok := value.(map[string]any); ok && h.identity.Seen(topic, payload) {
+			log.Printf("Dropping message on topic %s: %s already seen", topic, h.config.DedupField)
+			duplicateIDs.Inc()
+			h.drops.Drop(topic, dropDuplicateID)
+			return
+		}
+	}
+
+	if h.config.ControlChars != controlCharsAllow && containsControlChars(value) {
+		if h.config.ControlChars == controlCharsReject {
+			log.Printf("Dropping message on topic %s: control characters in payload", topic)
+			h.drops.Drop(topic, dropControlChars)
+			return
+		}
+		value = sanitizeValue(value)
+	}
+
+	if filters.Transform != nil {
+		result, err := expr.Run(filters.Transform, transformEnv{Topic: topic, Payload: value})
+		if err != nil {
+			log.Printf("Error transforming message from topic %s: %v", topic, err)
+			h.drops.Drop(topic, dropTransformError)
+			return
+		}
+		transformed, ok := result.(map[string]any)
+		if !ok {
+			log.Printf("Error transforming message from topic %s: result is %T, not a map", topic, result)
+			h.drops.Drop(topic, dropTransformError)
+			return
+		}
+		value = transformed
+	}
+
+	var extra []field
+	payload, _ := value.(map[string]any)
+
+	if catchingUp {
+		extra = append(extra, field{key: "catch_up", value: true})
+	}
+	if unwrapped {
+		extra = append(extra, field{key: "unwrapped", value: true})
+	}
+	if checksumFailure != "" {
+		extra = append(extra, field{key: "checksum_failure", value: checksumFailure})
+	}
+
+	if h.config.IncludeTopicDepth {
+		extra = append(extra, field{key: "topic_depth", value: topicDepth(topic)})
+	}
+
+	if valueType != "" {
+		extra = append(extra, field{key: "payload_type", value: valueType})
+	}
+
+	// The shape is the one received, before renaming or promoting fields
+	if h.config.IncludeShapeID && payload != nil {
+		extra = append(extra, field{key: "shape_id", value: shapeID(payload)})
+	}
+
+	if filters.NormalizeKeys != "" && filters.NormalizeOrder == normalizeBeforeRename && payload != nil {
+		if payload = h.normalizeKeys(topic, payload, filters); payload == nil {
+			return
+		}
+	}
+
+	if len(filters.RenameFields) > 0 && payload != nil {
+		renamed, collisions, err := renameFields(payload, filters.RenameFields, filters.RenameCollision)
+		if err != nil {
+			log.Printf("Dropping message on topic %s: %v", topic, err)
+			h.drops.Drop(topic, dropRenameCollision)
+			return
+		}
+		for _, collision := range collisions {
+			log.Printf("Rename collision on topic %s: %s", topic, collision)
+		}
+		payload = renamed
+	}
+
+	if filters.NormalizeKeys != "" && filters.NormalizeOrder == normalizeAfterRename && payload != nil {
+		if payload = h.normalizeKeys(topic, payload, filters); payload == nil {
+			return
+		}
+	}
+
+	if len(h.config.PromoteFields) > 0 && payload != nil {
+		promoted, collisions, err := promoteFields(payload, h.config.PromoteFields, h.config.PromoteMode == promoteModeMove, h.config.PromoteCollision)
+		if err != nil {
+			log.Printf("Dropping message on topic %s: %v", topic, err)
+			h.drops.Drop(topic, dropPromoteCollision)
+			return
+		}
+		for _, collision := range collisions {
+			log.Printf("Promote collision on topic %s: %s", topic, collision)
+		}
+		payload = promoted
+	}
+
+	if h.config.FloatPrecision != nil && payload != nil {
+		payload = roundFloats(payload, *h.config.FloatPrecision).(map[string]any)
+	}
+
+	var truncated bool
+	if h.config.MaxPayloadKeys > 0 {
+		if payload, truncated = truncateKeys(payload, h.config.MaxPayloadKeys); truncated {
+			payloadTruncations.Inc()
+		}
+	}
+	if h.config.MaxFieldLength > 0 || len(h.config.MaxFieldLengths) > 0 {
+		var count int
+		if payload, count = truncateFields(payload, h.config.MaxFieldLength, h.config.MaxFieldLengths); count > 0 {
+			fieldTruncations.Add(float64(count))
+			truncated = true
+		}
+	}
+	if truncated {
+		extra = append(extra, field{key: "truncated", value: true})
+	}
+
+	if len(filters.FieldTypes) > 0 && payload != nil {
+		checked, mismatches := checkFieldTypes(payload, filters.FieldTypes, h.config.OnTypeMismatch == typeMismatchCoerce)
+		if len(mismatches) > 0 {
+			typeMismatches.Add(float64(len(mismatches)))
+			switch h.config.OnTypeMismatch {
+			case typeMismatchDrop:
+				log.Printf("Dropping message on topic %s: unexpected type for %s", topic, strings.Join(mismatches, ", "))
+				h.drops.Drop(topic, dropTypeMismatch)
+				return
+			case typeMismatchFlag, typeMismatchCoerce:
+				log.Printf("Unexpected type on topic %s for %s", topic, strings.Join(mismatches, ", "))
+				extra = append(extra, field{key: "type_mismatch", value: strings.Join(mismatches, ",")})
+			}
+		}
+		payload = checked
+	}
+
+	if len(filters.FieldMatch) > 0 && !matchFields(payload, filters.FieldMatch) {
+		h.drops.Drop(topic, dropFieldMismatch)
+		return
+	}
+
+	// A payload is expected to be an object holding at least one of
+	// the output fields
+	if len(selectFields(payload, filters.OutputFields)) == 0 {
+		switch h.config.OnShapeMismatch {
+		case shapeMismatchDrop:
+			log.Printf("Dropping message on topic %s: no output field in payload", topic)
+			h.drops.Drop(topic, dropShapeMismatch)
+			return
+		case shapeMismatchFlag:
+			extra = append(extra, field{key: "shape_mismatch", value: true})
+		}
+	}
+
+	// Devices with a wrong clock can send timestamps far in the future
+	if skew := h.config.Timestamp.MaxClockSkew; skew > 0 && isFuture(payload[h.config.Timestamp.Field], time.Now(), skew) {
+		futureTimestamps.Inc()
+		if h.config.Timestamp.OnFuture == futureTimestampDrop {
+			log.Printf("Dropping message on topic %s: timestamp in the future", topic)
+			h.drops.Drop(topic, dropFutureTime)
+			return
+		}
+		extra = append(extra, field{key: "future_timestamp", value: true})
+	}
+
+	// Alerts are written after the message that raised them
+	var alerts []thresholdAlertMessage
+	if h.thresholds != nil && payload != nil {
+		alerts = h.thresholds.Check(topic, payload, received)
+	}
+
+	// Anomalies are reported once the message is recorded
+	anomalies := h.baseline.Compare(topic, payload, filters.OutputFields)
+	if len(anomalies) > 0 {
+		extra = append(extra, field{key: "baseline_anomaly", value: anomalyReasons(anomalies)})
+	}
+
+	// The record can only carry the time spent until it is written, the
+	// metric covers the write too
+	if h.config.IncludeProcessingTime {
+		extra = append(extra, field{key: "processing_us", value: int(time.Since(received).Microseconds())})
+	}
+
+	if err := h.writer.WriteMessage(topic, payload, filters.OutputFields, extra...); err != nil {
+		log.Printf("Error saving message: %v", err)
+		h.drops.Drop(topic, dropWriteError)
+		return
+	}
+	processingDuration.Observe(time.Since(received).Seconds())
+	if h.counts != nil {
+		h.counts.Observe(topic)
+	}
+	for _, alert := range alerts {
+		h.raiseAlert(client, alert)
+	}
+	if len(anomalies) > 0 {
+		h.reportAnomalies(topic, anomalies)
+	}
+	if h.config.MQTT.ManualAck {
+		h.writer.AckWhenWritten(msg.Ack)
+		deferredAck = true
+	}
+
+	log.Printf("Received message on topic %s", topic)
+}
+
+// normalizeKeys normalizes the payload keys with the filters, logging the
+// collisions. It returns nil when the message is dropped on a collision.
+func (h *Handler) normalizeKeys(topic string, payload map[string]any, filters *Filters) map[string]any {
+	normalized, collisions, err := normalizeKeys(payload, filters.NormalizeKeys, filters.RenameCollision)
+	if err != nil {
+		log.Printf("Dropping message on topic %s: %v", topic, err)
+		h.drops.Drop(topic, dropNormalizeCollision)
+		return nil
+	}
+	for _, collision := range collisions {
+		log.Printf("Normalize collision on topic %s: %s", topic, collision)
+	}
+	return normalized
+}
+
+// reportAnomalies logs and reports the ways a message deviates from the baseline
+func (h *Handler) reportAnomalies(topic string, anomalies []baselineAnomaly) {
+	for _, a := range anomalies {
+		baselineAnomalies.WithLabelValues(a.reason).Inc()
+	}
+	log.Printf("Baseline anomaly on topic %s: %s", topic, anomalyReasons(anomalies))
+	if err := h.baseline.Report(topic, anomalies); err != nil {
+		log.Printf("Error saving baseline anomaly: %v", err)
+	}
+}
+
+// raiseAlert logs a threshold alert, then records and publishes it as configured
+func (h *Handler) raiseAlert(client mqtt.Client, alert thresholdAlertMessage) {
+	thresholdAlerts.WithLabelValues(alert.State).Inc()
+	if alert.State == thresholdAlert {
+		log.Printf("Threshold alert on topic %s: %s is %v", alert.Topic, alert.Field, alert.Value)
+	} else {
+		log.Printf("Threshold alert cleared on topic %s: %s is %v", alert.Topic, alert.Field, alert.Value)
+	}
+
+	if h.config.ThresholdAlerts.Record {
+		if err := h.writer.WriteEvent("threshold", alert.fields()); err != nil {
+			log.Printf("Error saving threshold alert: %v", err)
+		}
+	}
+	if h.config.ThresholdAlerts.Topic != "" {
+		publishThresholdAlert(client, h.config.ThresholdAlerts.Topic, h.config.MQTT.QoS, alert)
+	}
+}
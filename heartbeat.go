@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startHeartbeat writes a heartbeat event every interval, so a consumer can
+// tell a quiet broker from a dead tracer. The returned function stops it.
+func startHeartbeat(client mqtt.Client, writer *FileWriter, drops *DropLog, interval time.Duration) func() {
+	return runEvery(interval, func() {
+		fields := map[string]string{
+			"messages":  strconv.FormatUint(writer.Recorded(), 10),
+			"dropped":   strconv.FormatUint(drops.Total(), 10),
+			"connected": strconv.FormatBool(client.IsConnectionOpen()),
+		}
+		if err := writer.WriteEvent("heartbeat", fields); err != nil {
+			log.Printf("Error saving heartbeat: %v", err)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// indexFileName is the name of the index of daily files, written next to them
+const indexFileName = "index.json"
+
+// FileIndex lists the output files with the time range and number of records
+// they hold, so the file covering a given time is easy to find
+type FileIndex struct {
+	path    string
+	entries []indexEntry
+}
+
+// indexEntry describes one output file of the index
+type indexEntry struct {
+	File    string `json:"file"`
+	First   string `json:"first"`
+	Last    string `json:"last"`
+	Records uint64 `json:"records"`
+}
+
+// loadFileIndex reads the index at path, if it exists, so files from previous
+// runs stay listed
+func loadFileIndex(path string) (*FileIndex, error) {
+	ix := &FileIndex{path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index file: %w", err)
+	}
+	if err := json.Unmarshal(data, &ix.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse index file %s: %w", path, err)
+	}
+	return ix, nil
+}
+
+// observe accounts for a line written to file
+func (ix *FileIndex) observe(file, line string) {
+	name := filepath.Base(file)
+	date, _, _ := strings.Cut(line, "|")
+
+	var entry *indexEntry
+	if n := len(ix.entries); n > 0 && ix.entries[n-1].File == name {
+		entry = &ix.entries[n-1]
+	} else {
+		for i := range ix.entries {
+			if ix.entries[i].File == name {
+				entry = &ix.entries[i]
+				break
+			}
+		}
+	}
+	if entry == nil {
+		ix.entries = append(ix.entries, indexEntry{File: name, First: date})
+		entry = &ix.entries[len(ix.entries)-1]
+	}
+
+	entry.Last = date
+	entry.Records++
+}
+
+// save rewrites the index atomically, so a crash never leaves a partial index
+func (ix *FileIndex) save() error {
+	data, err := json.MarshalIndent(ix.entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index file: %w", err)
+	}
+
+	if err := writeFileAtomic(ix.path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	return nil
+}
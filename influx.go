@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// influxNameEscaper escapes measurement names
+	influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	// influxKeyEscaper escapes tag keys, tag values and field keys
+	influxKeyEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	// influxStringEscaper escapes string field values
+	influxStringEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// errNoInfluxField is returned when a record has no field to write, which
+// InfluxDB line protocol requires
+var errNoInfluxField = errors.New("no field to write in line protocol")
+
+// influxLine formats a record as InfluxDB line protocol:
+// <measurement>,<tag>=<value>... <field>=<value>... <timestamp in ns>
+func influxLine(measurement string, tags, fields []field, t time.Time) (string, error) {
+	var b strings.Builder
+	b.WriteString(influxNameEscaper.Replace(measurement))
+
+	for _, tag := range tags {
+		value := fmt.Sprint(tag.value)
+		if value == "" {
+			// Empty tag values are not allowed
+			continue
+		}
+		fmt.Fprintf(&b, ",%s=%s", influxKeyEscaper.Replace(tag.key), influxKeyEscaper.Replace(value))
+	}
+
+	written := 0
+	for _, f := range fields {
+		value, ok := influxValue(f.value)
+		if !ok {
+			continue
+		}
+		if written == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%s", influxKeyEscaper.Replace(f.key), value)
+		written++
+	}
+	if written == 0 {
+		return "", errNoInfluxField
+	}
+
+	fmt.Fprintf(&b, " %d", t.UnixNano())
+	return b.String(), nil
+}
+
+// influxValue formats a field value: numbers as floats (JSON numbers have no
+// integer type), booleans as is, anything else as a string. Null values are skipped.
+func influxValue(value any) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case int:
+		return strconv.Itoa(v) + "i", true
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`, true
+	}
+	return `"` + influxStringEscaper.Replace(fmt.Sprint(value)) + `"`, true
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// initDialTimeout bounds the check that the broker is reachable
+const initDialTimeout = 5 * time.Second
+
+// prompter asks questions on the terminal, reading the answers line by line
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask asks a question until validate accepts the answer, def being the
+// answer when empty if not empty itself. validate may be nil.
+func (p *prompter) ask(question, def string, validate func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+		line, err := p.in.ReadString('\n')
+		if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+			if errors.Is(err, io.EOF) {
+				return "", fmt.Errorf("no answer to %q", question)
+			}
+			return "", err
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if validate == nil {
+			return answer, nil
+		}
+		if err := validate(answer); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// confirm asks a yes or no question
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	choices := "y/N"
+	if def {
+		choices = "Y/n"
+	}
+	answer, err := p.ask(question+" ("+choices+")", "", func(s string) error {
+		switch strings.ToLower(s) {
+		case "", "y", "yes", "n", "no":
+			return nil
+		}
+		return fmt.Errorf("answer y or n")
+	})
+	if err != nil {
+		return false, err
+	}
+	if answer == "" {
+		return def, nil
+	}
+	return strings.HasPrefix(strings.ToLower(answer), "y"), nil
+}
+
+// initConfig interactively writes a configuration file to configPath: it
+// asks for the broker, credentials, topics and output file, validates the
+// resulting configuration as loadConfig does and writes it atomically
+func initConfig(configPath string) error {
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+	if _, err := os.Stat(configPath); err == nil {
+		overwrite, err := p.confirm(configPath+" exists, overwrite it?", false)
+		if err != nil {
+			return err
+		}
+		if !overwrite {
+			return fmt.Errorf("%s exists, not overwritten", configPath)
+		}
+	}
+
+	var broker, port string
+	for {
+		var err error
+		broker, err = p.ask("MQTT broker host", "localhost", func(s string) error {
+			if s == "" || strings.ContainsAny(s, " /") {
+				return fmt.Errorf("enter a host name or IP address, without scheme or port")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		port, err = p.ask("MQTT broker port", "1883", func(s string) error {
+			if n, err := strconv.Atoi(s); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("enter a port between 1 and 65535")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		check, err := p.confirm("Check that the broker is reachable?", true)
+		if err != nil {
+			return err
+		}
+		if !check {
+			break
+		}
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(broker, port), initDialTimeout)
+		if err == nil {
+			conn.Close()
+			fmt.Fprintln(p.out, "  Broker reachable")
+			break
+		}
+		fmt.Fprintf(p.out, "  Broker not reachable: %v\n", err)
+		keep, err := p.confirm("Keep this broker anyway?", false)
+		if err != nil {
+			return err
+		}
+		if keep {
+			break
+		}
+	}
+
+	useTLS, err := p.confirm("Use TLS?", port == "8883")
+	if err != nil {
+		return err
+	}
+	username, err := p.ask("Username (empty for none)", "", nil)
+	if err != nil {
+		return err
+	}
+	var password string
+	if username != "" {
+		if password, err = p.ask("Password (shown as typed)", "", nil); err != nil {
+			return err
+		}
+	}
+
+	var topics []string
+	for {
+		question := "Topic filter to subscribe to"
+		def := "#"
+		if len(topics) > 0 {
+			question = "Another topic filter (empty to finish)"
+			def = ""
+		}
+		topic, err := p.ask(question, def, func(s string) error {
+			if s == "" && len(topics) > 0 {
+				return nil
+			}
+			return validateTopicFilter(s)
+		})
+		if err != nil {
+			return err
+		}
+		if topic == "" {
+			break
+		}
+		topics = append(topics, topic)
+	}
+
+	outputFile, err := p.ask("Output file", "mqtt-trace.log", func(s string) error {
+		if info, err := os.Stat(filepath.Dir(s)); err != nil || !info.IsDir() {
+			return fmt.Errorf("directory %s doesn't exist", filepath.Dir(s))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fields, err := p.ask("Payload fields to record, comma-separated", "name,rssi", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if strings.TrimSpace(name) == "" {
+				return fmt.Errorf("field names must not be empty")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "mqtt:\n")
+	fmt.Fprintf(&b, "  broker: %s\n", strconv.Quote(broker))
+	fmt.Fprintf(&b, "  port: %s\n", port)
+	if username != "" {
+		fmt.Fprintf(&b, "  username: %s\n", strconv.Quote(username))
+		fmt.Fprintf(&b, "  password: %s\n", strconv.Quote(password))
+	}
+	fmt.Fprintf(&b, "  topics:\n")
+	for _, topic := range topics {
+		fmt.Fprintf(&b, "    - %s\n", strconv.Quote(topic))
+	}
+	if useTLS {
+		fmt.Fprintf(&b, "\ntls:\n  enabled: true\n")
+	}
+	fmt.Fprintf(&b, "\noutput_file: %s\n", strconv.Quote(outputFile))
+	fmt.Fprintf(&b, "output_fields:\n")
+	for _, name := range strings.Split(fields, ",") {
+		fmt.Fprintf(&b, "  - %s\n", strconv.Quote(strings.TrimSpace(name)))
+	}
+	data := []byte(b.String())
+
+	// The configuration is loaded back before being written, so that a
+	// written file is always valid
+	if err := validateConfigData(data); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(configPath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", configPath, err)
+	}
+	fmt.Fprintf(p.out, "Configuration written to %s, start tracing with: mqtt-trace %s\n", configPath, configPath)
+	return nil
+}
+
+// validateConfigData validates a configuration with loadConfig, from a
+// temporary file
+func validateConfigData(data []byte) error {
+	file, err := os.CreateTemp("", "mqtt-trace-init-*.yaml")
+	if err != nil {
+		return fmt.Errorf("failed to validate the configuration: %w", err)
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to validate the configuration: %w", err)
+	}
+	if _, err := loadConfig(file.Name()); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	return nil
+}
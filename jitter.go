@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JitterStats tracks the mean and standard deviation of the inter-arrival
+// times of each topic, using Welford's streaming algorithm so no sample has
+// to be kept in memory
+type JitterStats struct {
+	mu     sync.Mutex
+	topics map[string]*arrivalStats
+	lru    *topicLRU
+}
+
+// arrivalStats holds the running statistics of one topic
+type arrivalStats struct {
+	last  time.Time
+	count uint64 // number of intervals, one less than the number of messages
+	mean  float64
+	m2    float64
+}
+
+// NewJitterStats creates empty jitter statistics, for up to maxTopics
+// topics or any number if maxTopics is 0
+func NewJitterStats(maxTopics int) *JitterStats {
+	return &JitterStats{
+		topics: make(map[string]*arrivalStats),
+		lru:    newTopicLRU("jitter_stats", maxTopics),
+	}
+}
+
+// Observe accounts for a message received on topic at t
+func (j *JitterStats) Observe(topic string, t time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.lru != nil {
+		if evicted, ok := j.lru.touch(topic); ok {
+			delete(j.topics, evicted)
+			interarrivalMean.DeleteLabelValues(evicted)
+			interarrivalStddev.DeleteLabelValues(evicted)
+		}
+	}
+
+	stats, ok := j.topics[topic]
+	if !ok {
+		j.topics[topic] = &arrivalStats{last: t}
+		return
+	}
+
+	interval := t.Sub(stats.last).Seconds()
+	stats.last = t
+	stats.count++
+	delta := interval - stats.mean
+	stats.mean += delta / float64(stats.count)
+	stats.m2 += delta * (interval - stats.mean)
+}
+
+// stddev returns the sample standard deviation of the intervals
+func (s *arrivalStats) stddev() float64 {
+	if s.count < 2 {
+		return 0
+	}
+	return math.Sqrt(s.m2 / float64(s.count-1))
+}
+
+// Report exports the statistics of every topic with at least one interval
+// as metrics and as jitter events written to the output file
+func (j *JitterStats) Report(writer *FileWriter) {
+	j.mu.Lock()
+	topics := make([]string, 0, len(j.topics))
+	for topic, stats := range j.topics {
+		if stats.count > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	sort.Strings(topics)
+
+	events := make([]map[string]string, 0, len(topics))
+	for _, topic := range topics {
+		stats := j.topics[topic]
+		interarrivalMean.WithLabelValues(topic).Set(stats.mean)
+		interarrivalStddev.WithLabelValues(topic).Set(stats.stddev())
+		events = append(events, map[string]string{
+			"topic":     topic,
+			"intervals": fmt.Sprint(stats.count),
+			"mean":      fmt.Sprintf("%.3f", stats.mean),
+			"stddev":    fmt.Sprintf("%.3f", stats.stddev()),
+		})
+	}
+	j.mu.Unlock()
+
+	for _, fields := range events {
+		if err := writer.WriteEvent("jitter", fields); err != nil {
+			log.Printf("Error saving jitter statistics: %v", err)
+		}
+	}
+}
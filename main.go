@@ -1,95 +1,1258 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
 // Config holds the application configuration
 type Config struct {
 	MQTT struct {
-		Broker   string   `mapstructure:"broker"`
-		Port     int      `mapstructure:"port"`
-		Username string   `mapstructure:"username"`
-		Password string   `mapstructure:"password"`
-		Topics   []string `mapstructure:"topics"`
+		Broker   string        `mapstructure:"broker"`
+		Port     int           `mapstructure:"port"`
+		Username string        `mapstructure:"username"`
+		Password string        `mapstructure:"password"`
+		Topics   []TopicConfig `mapstructure:"topics"`
+		QoS      byte          `mapstructure:"qos"`
+		// ResubscribeQoS is the QoS used when resubscribing after a
+		// reconnect: granted (by the first SUBACK) or requested
+		ResubscribeQoS string `mapstructure:"resubscribe_qos"`
+		// DefaultPublishHandler also routes messages that match no
+		// subscription through the message handler
+		DefaultPublishHandler bool `mapstructure:"default_publish_handler"`
+		// StartupBuffer holds up to that many messages received before the
+		// initial subscriptions complete, 0 to handle them right away
+		StartupBuffer int `mapstructure:"startup_buffer"`
+		// FailoverBrokers are host[:port] brokers connected to in turn,
+		// after the primary one, each time FailoverAfter connection
+		// attempts in a row failed
+		FailoverBrokers []string `mapstructure:"failover_brokers"`
+		FailoverAfter   int      `mapstructure:"failover_after"`
+		// Brokers are the host:port of the primary and failover brokers
+		Brokers []string `mapstructure:"-"`
+		// RetryUnresolved keeps retrying to connect when the broker host
+		// doesn't resolve at startup, instead of failing
+		RetryUnresolved bool `mapstructure:"retry_unresolved"`
+		// RetryOnAuthFailure keeps retrying to connect when the broker
+		// refuses the credentials, instead of stopping with an error
+		RetryOnAuthFailure bool `mapstructure:"retry_on_auth_failure"`
+		// ManualAck acknowledges QoS 1/2 messages only once they are
+		// written to the output file
+		ManualAck          bool `mapstructure:"manual_ack"`
+		ManualAckThreshold int  `mapstructure:"manual_ack_threshold"`
+		// ReadBuffer and WriteBuffer are the socket buffer sizes in
+		// bytes, 0 keeps the OS defaults
+		ReadBuffer  int `mapstructure:"read_buffer"`
+		WriteBuffer int `mapstructure:"write_buffer"`
+		// MaxInflight bounds the QoS 1/2 publishes resent at once when
+		// reconnecting, 0 for no limit
+		MaxInflight int `mapstructure:"max_inflight"`
+		// Birth is published on every connection, disabled without a topic
+		Birth struct {
+			Topic    string `mapstructure:"topic"`
+			Payload  string `mapstructure:"payload"`
+			QoS      byte   `mapstructure:"qos"`
+			Retained bool   `mapstructure:"retained"`
+		} `mapstructure:"birth"`
 	} `mapstructure:"mqtt"`
+	TLS struct {
+		Enabled            bool   `mapstructure:"enabled"`
+		CAFile             string `mapstructure:"ca_file"`
+		CADir              string `mapstructure:"ca_dir"`
+		UseSystemPool      bool   `mapstructure:"use_system_pool"`
+		CertFile           string `mapstructure:"cert_file"`
+		KeyFile            string `mapstructure:"key_file"`
+		InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
+		ExpiryWarnDays     int    `mapstructure:"expiry_warn_days"`
+		// ExpiryAlertTopic is where an alert is published when the broker
+		// certificate expires within ExpiryWarnDays, warn only when empty
+		ExpiryAlertTopic string `mapstructure:"expiry_alert_topic"`
+		RecordDetails    bool   `mapstructure:"record_details"`
+		// MinVersion is the lowest TLS version accepted: 1.2 or 1.3
+		MinVersion string `mapstructure:"min_version"`
+	} `mapstructure:"tls"`
 	OutputFile string `mapstructure:"output_file"`
+	OnExisting string `mapstructure:"on_existing"`
+	// OutputType is how the output file is written: file, mmap or ring
+	OutputType string `mapstructure:"output_type"`
+	// RingSize is the size of the data of the ring file with output_type ring
+	RingSize int `mapstructure:"ring_size"`
+	// Shards splits the messages across as many output files, by the hash of
+	// ShardKey: topic, or the dotted path of a payload field. Disabled
+	// below 2.
+	Shards   int    `mapstructure:"shards"`
+	ShardKey string `mapstructure:"shard_key"`
+	// OutputCompression compresses the output file as it is written: none or gzip
+	OutputCompression string `mapstructure:"output_compression"`
+	// GzipFlushInterval is how often the gzip stream is flushed, so the file
+	// can be decompressed up to the last flush
+	GzipFlushInterval time.Duration `mapstructure:"gzip_flush_interval"`
+	// MaxConsecutiveWriteErrors stops the tool with an error after that many
+	// writes failed in a row, 0 to never stop
+	MaxConsecutiveWriteErrors int `mapstructure:"max_consecutive_write_errors"`
+	// ConnectTiming measures and logs the phases of the broker connection
+	ConnectTiming bool `mapstructure:"connect_timing"`
+	// SampleSeed seeds the random sampling of the topics with a sample_ratio
+	SampleSeed uint64 `mapstructure:"sample_seed"`
+	// AuditFile records the connection lifecycle events when set
+	AuditFile string `mapstructure:"audit_file"`
+	// EventWebhook posts the connection lifecycle events to URL when set,
+	// retrying failed posts up to MaxRetries times
+	EventWebhook struct {
+		URL        string        `mapstructure:"url"`
+		Timeout    time.Duration `mapstructure:"timeout"`
+		MaxRetries int           `mapstructure:"max_retries"`
+	} `mapstructure:"event_webhook"`
+	// StateFile holds the latest record of each topic, written every StateInterval
+	StateFile     string        `mapstructure:"state_file"`
+	StateInterval time.Duration `mapstructure:"state_interval"`
+	// SummaryFile holds the capture summary with the recorded messages per
+	// subscription, written at shutdown and every SummaryInterval if positive
+	SummaryFile     string        `mapstructure:"summary_file"`
+	SummaryInterval time.Duration `mapstructure:"summary_interval"`
+	// MaxTrackedTopics bounds the number of topics of the per-topic
+	// bookkeeping (jitter statistics, state file), 0 for no limit
+	MaxTrackedTopics int `mapstructure:"max_tracked_topics"`
+	// DedupRedelivered drops the QoS 1/2 messages received twice within a flush interval
+	DedupRedelivered bool `mapstructure:"dedup_redelivered"`
+	// DedupField drops the messages whose value of this payload field was
+	// already seen on their topic, among the last DedupLRUSize ones
+	DedupField   string `mapstructure:"dedup_field"`
+	DedupLRUSize int    `mapstructure:"dedup_lru_size"`
+	// MaxDuration stops the capture after the given time, 0 for no limit
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+	// ArchiveOnExit packs the output files into a tar.gz when stopping
+	ArchiveOnExit bool `mapstructure:"archive_on_exit"`
+	// ArchiveDaily compresses each finished daily file to archive/<day>,
+	// along with a manifest
+	ArchiveDaily bool `mapstructure:"archive_daily"`
+	// OutputFormat is the format of the records: line, influx, grouped or msgpack
+	OutputFormat string `mapstructure:"output_format"`
+	// GroupBy is what the grouped format groups the records by: topic, or
+	// the dotted path of a payload field, records without it being grouped
+	// under GroupDefault
+	GroupBy      string `mapstructure:"group_by"`
+	GroupDefault string `mapstructure:"group_default"`
+	// Envelope is a JSON template of the records of the grouped and msgpack
+	// formats and of the state file, the current shape when empty
+	Envelope string `mapstructure:"envelope"`
+	// EnvelopeTemplate is the parsed Envelope
+	EnvelopeTemplate map[string]any `mapstructure:"-"`
+	// OutputEscapeHTML escapes <, > and & in JSON output, as encoding/json does by default
+	OutputEscapeHTML bool `mapstructure:"output_escape_html"`
+	// CanonicalJSON writes the JSON sorted and without whitespace, so the
+	// same payload always encodes the same
+	CanonicalJSON     bool   `mapstructure:"canonical_json"`
+	InfluxMeasurement string `mapstructure:"influx_measurement"`
+	MmapSize          int    `mapstructure:"mmap_size"`
+	DailyFiles        bool   `mapstructure:"daily_files"`
+	IndexFile         bool   `mapstructure:"index_file"`
+	Timezone          string `mapstructure:"timezone"`
+	// Location is the parsed Timezone
+	Location      *time.Location `mapstructure:"-"`
+	DroppedLog    string         `mapstructure:"dropped_log"`
+	ErrorsFile    string         `mapstructure:"errors_file"`
+	FlushInterval time.Duration  `mapstructure:"flush_interval"`
+	BufferSize    int            `mapstructure:"buffer_size"`
+	SortBatchBy   string         `mapstructure:"sort_batch_by"`
+	// Downsample records only the latest message of each topic every
+	// Interval, disabled when 0
+	Downsample struct {
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"downsample"`
+	BinaryTopics     []string `mapstructure:"binary_topics"`
+	StrictConfig     bool     `mapstructure:"strict_config"`
+	MonotonicField   string   `mapstructure:"monotonic_field"`
+	IncludeSessionID bool     `mapstructure:"include_session_id"`
+	// SessionID defaults to a random UUID generated at startup
+	SessionID     string `mapstructure:"session_id"`
+	IncludeBroker bool   `mapstructure:"include_broker"`
+	// BrokerLabel defaults to the broker host:port
+	BrokerLabel       string `mapstructure:"broker_label"`
+	IncludeTopicDepth bool   `mapstructure:"include_topic_depth"`
+	// IncludePayloadType records the JSON type of the payload
+	IncludePayloadType bool `mapstructure:"include_payload_type"`
+	// IncludeShapeID records a fingerprint of the payload keys
+	IncludeShapeID bool `mapstructure:"include_shape_id"`
+	// IncludeProcessingTime records the time spent handling each message
+	IncludeProcessingTime bool          `mapstructure:"include_processing_time"`
+	OutputFields          []string      `mapstructure:"output_fields"`
+	RenameFields          []FieldRename `mapstructure:"rename_fields"`
+	RenameCollision       string        `mapstructure:"rename_collision"`
+	// NormalizeKeys normalizes the case of the payload keys: lower, upper
+	// or snake, before or after rename_fields with NormalizeOrder
+	NormalizeKeys  string `mapstructure:"normalize_keys"`
+	NormalizeOrder string `mapstructure:"normalize_order"`
+	// PromoteFields are dotted paths of nested fields copied (or moved,
+	// with PromoteMode) to the top level of the payload
+	PromoteFields    []string `mapstructure:"promote_fields"`
+	PromoteMode      string   `mapstructure:"promote_mode"`
+	PromoteCollision string   `mapstructure:"promote_collision"`
+	// TimeFields are fields derived from the record time, e.g. hour or iso_week
+	TimeFields []string `mapstructure:"time_fields"`
+	// MissingField is how absent output fields are written: omit, null or empty
+	MissingField string `mapstructure:"missing_field"`
+	Transform    string `mapstructure:"transform"`
+	// UnwrapJSONString decodes payloads that are a JSON string holding JSON
+	UnwrapJSONString bool `mapstructure:"unwrap_json_string"`
+	MaxPayloadKeys   int  `mapstructure:"max_payload_keys"`
+	// MaxFieldLength truncates the longer payload strings, those of the
+	// top-level fields of MaxFieldLengths to their own length, 0 for none
+	MaxFieldLength  int            `mapstructure:"max_field_length"`
+	MaxFieldLengths map[string]int `mapstructure:"max_field_lengths"`
+	// FloatPrecision rounds the payload numbers to as many decimal places
+	// when set
+	FloatPrecision *int `mapstructure:"float_precision"`
+	// FieldTypes are the types expected for output fields: number, string
+	// or bool
+	FieldTypes map[string]string `mapstructure:"field_types"`
+	// FieldMatch maps payload field paths to the regular expressions they
+	// must match for a message to be recorded
+	FieldMatch map[string]any `mapstructure:"field_match"`
+	// OnTypeMismatch is one of record, flag, drop or coerce
+	OnTypeMismatch string `mapstructure:"on_type_mismatch"`
+	// Checksum verifies the payload checksums, when checksum.field is set
+	Checksum ChecksumConfig `mapstructure:"checksum"`
+	// GRPC streams the records to a gRPC server, when grpc.endpoint is set
+	GRPC GRPCConfig `mapstructure:"grpc"`
+	// Baseline reports the records deviating from a previous trace, when
+	// baseline.file is set
+	Baseline BaselineConfig `mapstructure:"baseline"`
+	// Thresholds raise alerts when payload fields cross them
+	Thresholds      []Threshold `mapstructure:"thresholds"`
+	ThresholdAlerts struct {
+		// Record writes the alerts to the output file as threshold events
+		Record bool `mapstructure:"record"`
+		// Topic is where the alerts are published, not published when empty
+		Topic string `mapstructure:"topic"`
+	} `mapstructure:"threshold_alerts"`
+	// Schedule limits the recording to its windows, in its timezone,
+	// timezone by default
+	Schedule struct {
+		Timezone string           `mapstructure:"timezone"`
+		Windows  []ScheduleWindow `mapstructure:"windows"`
+		// Location is the parsed Timezone
+		Location *time.Location `mapstructure:"-"`
+	} `mapstructure:"schedule"`
+	// ControlChars is what to do with control characters in topics and
+	// payload strings: allow, sanitize or reject
+	ControlChars string `mapstructure:"control_chars"`
+	// OnShapeMismatch is one of record, drop or flag
+	OnShapeMismatch string        `mapstructure:"on_shape_mismatch"`
+	StatusTopic     string        `mapstructure:"status_topic"`
+	StatusInterval  time.Duration `mapstructure:"status_interval"`
+	Timestamp       struct {
+		Truncate time.Duration `mapstructure:"truncate"`
+		// Field is the payload field holding the device timestamp,
+		// sort_batch_by by default
+		Field        string        `mapstructure:"field"`
+		MaxClockSkew time.Duration `mapstructure:"max_clock_skew"`
+		OnFuture     string        `mapstructure:"on_future"`
+	} `mapstructure:"timestamp"`
+	JitterStats struct {
+		Enabled  bool          `mapstructure:"enabled"`
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"jitter_stats"`
+	QualityScore struct {
+		Enabled  bool          `mapstructure:"enabled"`
+		Interval time.Duration `mapstructure:"interval"`
+		// Gap is how long without any message counts as a gap
+		Gap time.Duration `mapstructure:"gap"`
+		// Record writes each score to the output file as a quality event
+		Record bool `mapstructure:"record"`
+	} `mapstructure:"quality_score"`
+	Discovery struct {
+		// Topic is the discovery topic filter, disabled when empty
+		Topic  string   `mapstructure:"topic"`
+		Fields []string `mapstructure:"fields"`
+	} `mapstructure:"discovery"`
+	CatchUp struct {
+		Enabled bool          `mapstructure:"enabled"`
+		Window  time.Duration `mapstructure:"window"`
+		Gap     time.Duration `mapstructure:"gap"`
+	} `mapstructure:"catch_up"`
+	DistinctPayloads struct {
+		Enabled bool `mapstructure:"enabled"`
+		LRUSize int  `mapstructure:"lru_size"`
+	} `mapstructure:"distinct_payloads"`
+	Metrics struct {
+		Listen string `mapstructure:"listen"`
+	} `mapstructure:"metrics"`
+	// Stream serves the live records as server-sent events on /stream,
+	// disabled when Listen is empty
+	Stream struct {
+		Listen string `mapstructure:"listen"`
+		// Buffer is the number of records held for each client, those of
+		// a client without room being handled as set by OnSlowClient
+		Buffer       int    `mapstructure:"buffer"`
+		OnSlowClient string `mapstructure:"on_slow_client"`
+	} `mapstructure:"stream"`
+	// Pprof serves the runtime profiles over HTTP, on metrics.listen by default
+	Pprof struct {
+		Enabled bool   `mapstructure:"enabled"`
+		Listen  string `mapstructure:"listen"`
+	} `mapstructure:"pprof"`
+	Shutdown struct {
+		// DrainTimeout bounds the wait for the messages already received
+		// to be handled when stopping, 0 to stop right away
+		DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	} `mapstructure:"shutdown"`
+	Heartbeat struct {
+		Enabled  bool          `mapstructure:"enabled"`
+		Interval time.Duration `mapstructure:"interval"`
+	} `mapstructure:"heartbeat"`
 }
 
+// startTime is when the tracer started
+var startTime = time.Now()
+
+// binaryPreviewSize is the number of leading bytes of a binary payload recorded as a preview
+const binaryPreviewSize = 16
+
 // FileWriter handles writing messages to the output file
 type FileWriter struct {
 	mu       sync.Mutex
 	filePath string
+	file     *os.File
+	buf      *bufio.Writer
+	mmap     *mmapWriter
+	ring     *ringWriter
+	recorded atomic.Uint64
+
+	// gzip compresses the output lines when set, it is flushed every
+	// gzipFlushInterval, gzipFlushed being when it last was
+	gzip              *gzip.Writer
+	gzipFlushInterval time.Duration
+	gzipFlushed       time.Time
+	location          *time.Location
+	truncate          time.Duration
+
+	// With daily files, day is the date of the file currently written to
+	daily bool
+	day   string
+	// index lists the daily files, when enabled
+	index *FileIndex
+	// archiveDaily compresses each finished daily file to its archive directory
+	archiveDaily bool
+	// files are the output files written to, in order
+	files []string
+
+	// start carries Go's monotonic clock reading, elapsed times computed
+	// from it are not affected by wall-clock adjustments
+	start          time.Time
+	monotonicField string
+
+	// sessionID identifies the capture run and broker the source broker
+	// in every record when set, broker changing with failovers
+	sessionID string
+	broker    atomic.Value
+
+	missingField string
+	// timeFields are the fields derived from the record time added to messages
+	timeFields []string
+	// format is the format of the lines, measurement the InfluxDB
+	// measurement name with the influx format
+	format      string
+	measurement string
+
+	// With the grouped format, groups holds all the records by topic or
+	// groupBy payload field, dirty tells whether some were added since the
+	// file was last written
+	groups       map[string][]map[string]any
+	dirty        bool
+	groupBy      string
+	groupDefault string
+	// escapeHTML escapes <, > and & in the JSON of the grouped and state files
+	escapeHTML bool
+	// canonical writes the records as canonical JSON, nested values of the
+	// line and influx formats included, and sorts the MessagePack maps
+	canonical bool
+	// envelope is the shape of the message records when set
+	envelope map[string]any
+	// ts encodes the messages with the timeseries format
+	ts *tsEncoder
+	// grpc streams the messages to a gRPC server when set
+	grpc *GRPCForwarder
+	// stream fans the messages out to the clients of the /stream endpoint
+	// when set
+	stream *StreamHub
+	// shards are the output files the messages are sharded across by the
+	// hash of shardKey, when more than one, the first being file and buf.
+	// Events go to all of them.
+	shards   []*outputShard
+	shardKey string
+	// paused skips the events while recording is paused, the messages being
+	// dropped by the handler
+	paused atomic.Bool
+
+	// state holds the latest record of each topic, written to statePath
+	state      map[string]map[string]any
+	statePath  string
+	stateDirty bool
+	// stateTopics bounds the number of topics in state
+	stateTopics *topicLRU
+
+	// When sortBy is set, message lines are held in batch and written sorted
+	// by the payload time field every flush interval
+	sortBy string
+	batch  []batchedLine
+	// When downsampling, latest maps each topic to its line in batch, so
+	// only the latest message of a topic is written every flush
+	latest map[string]int
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// window holds the keys of the messages received since the last flush,
+	// when redelivered duplicates are dropped
+	window map[[sha256.Size]byte]struct{}
+
+	// writeErrors counts the consecutive write errors, failed is closed
+	// when it reaches maxWriteErrors
+	writeErrors    int
+	maxWriteErrors int
+	failed         chan struct{}
+	failOnce       sync.Once
+	// closing is set under mu when Close starts, before it waits for wg
+	closing bool
+
+	// pendingAcks are the MQTT acknowledgments of messages not flushed yet
+	pendingAcks  []func()
+	ackThreshold int
+	// flushed is the number of messages recorded as of the last successful
+	// flush, those recorded since waiting to be written
+	flushed atomic.Uint64
+}
+
+// field is an extra key/value written after the payload fields
+type field struct {
+	key   string
+	value any
+}
+
+// batchedLine is a message line waiting for the next flush
+type batchedLine struct {
+	at   time.Time
+	line string
+}
+
+// NewFileWriter creates a new file writer, opening the output file in append mode
+func NewFileWriter(config *Config) (*FileWriter, error) {
+	fw := &FileWriter{
+		filePath:       config.OutputFile,
+		location:       config.Location,
+		truncate:       config.Timestamp.Truncate,
+		daily:          config.DailyFiles,
+		timeFields:     config.TimeFields,
+		escapeHTML:     config.OutputEscapeHTML,
+		canonical:      config.CanonicalJSON,
+		envelope:       config.EnvelopeTemplate,
+		archiveDaily:   config.ArchiveDaily,
+		start:          time.Now(),
+		monotonicField: config.MonotonicField,
+		sessionID:      config.SessionID,
+		missingField:   config.MissingField,
+		format:         config.OutputFormat,
+		groupBy:        config.GroupBy,
+		groupDefault:   config.GroupDefault,
+		measurement:    config.InfluxMeasurement,
+		sortBy:         config.SortBatchBy,
+		ackThreshold:   config.MQTT.ManualAckThreshold,
+		maxWriteErrors: config.MaxConsecutiveWriteErrors,
+		failed:         make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	fw.broker.Store(config.BrokerLabel)
+
+	recoverFile := func(path string) error {
+		if config.OutputCompression == compressionGzip {
+			return nil
+		}
+		switch config.OutputFormat {
+		case outputFormatMsgpack:
+			return recoverMsgpack(path)
+		case outputFormatTimeseries:
+			return recoverTimeseries(path)
+		}
+		return nil
+	}
+
+	path := fw.filePath
+	if fw.daily {
+		fw.day = fw.now().Format(time.DateOnly)
+		path = dailyPath(fw.filePath, fw.day)
+
+		if config.IndexFile {
+			index, err := loadFileIndex(filepath.Join(filepath.Dir(fw.filePath), indexFileName))
+			if err != nil {
+				return nil, err
+			}
+			fw.index = index
+		}
+	}
+	if config.OutputFormat == outputFormatTimeseries {
+		fw.ts = newTSEncoder()
+	}
+	if config.OutputFormat == outputFormatGrouped {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output file: %w", err)
+		}
+		fw.file = file
+		if fw.groups, err = loadGrouped(file); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if config.OutputType == outputTypeMmap {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output file: %w", err)
+		}
+		fw.file = file
+		if fw.mmap, err = newMmapWriter(file, config.MmapSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else if config.OutputType == outputTypeRing {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open output file: %w", err)
+		}
+		fw.file = file
+		if fw.ring, err = newRingWriter(file, config.RingSize); err != nil {
+			file.Close()
+			return nil, err
+		}
+	} else {
+		if config.Shards > 1 {
+			path = shardPath(path, 0)
+		}
+		// A crash can leave a partial last frame, later frames would be
+		// read from the middle of it
+		if err := recoverFile(path); err != nil {
+			return nil, err
+		}
+		file, err := openOutputFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fw.file = file
+	}
+
+	fw.files = append(fw.files, path)
+
+	// Each opening starts a new gzip member, concatenated members being a
+	// valid gzip file
+	var out io.Writer = fw.file
+	if config.OutputCompression == compressionGzip {
+		fw.gzip = gzip.NewWriter(fw.file)
+		fw.gzipFlushInterval = config.GzipFlushInterval
+		fw.gzipFlushed = time.Now()
+		out = fw.gzip
+	}
+
+	// Without a buffer, lines are written to the file as they come
+	if config.BufferSize > 0 {
+		fw.buf = bufio.NewWriterSize(out, config.BufferSize)
+	}
+
+	if config.Shards > 1 {
+		fw.shards = []*outputShard{{file: fw.file, buf: fw.buf}}
+		fw.shardKey = config.ShardKey
+		if err := fw.openShards(fw.filePath, config.Shards, config.BufferSize, recoverFile); err != nil {
+			fw.closeOpened()
+			return nil, err
+		}
+	}
+
+	if config.DedupRedelivered {
+		fw.window = make(map[[sha256.Size]byte]struct{})
+	}
+
+	if config.GRPC.Endpoint != "" {
+		forwarder, err := NewGRPCForwarder(config.GRPC)
+		if err != nil {
+			fw.closeOpened()
+			return nil, err
+		}
+		fw.grpc = forwarder
+	}
+	if config.Stream.Listen != "" {
+		fw.stream = NewStreamHub(config.Stream.Buffer, config.Stream.OnSlowClient)
+	}
+
+	if config.StateFile != "" {
+		fw.state = make(map[string]map[string]any)
+		fw.statePath = config.StateFile
+		fw.stateTopics = newTopicLRU("state_file", config.MaxTrackedTopics)
+	}
+
+	// Downsampling writes the latest messages every interval instead
+	interval := config.FlushInterval
+	if config.Downsample.Interval > 0 {
+		fw.latest = make(map[string]int)
+		interval = config.Downsample.Interval
+	}
+
+	if fw.sortBy != "" || fw.buf != nil || fw.mmap != nil || fw.gzip != nil || fw.window != nil || fw.groups != nil || fw.latest != nil {
+		fw.wg.Add(1)
+		go fw.flushLoop(interval)
+	}
+
+	return fw, nil
 }
 
-// NewFileWriter creates a new file writer
-func NewFileWriter(filePath string) *FileWriter {
-	return &FileWriter{
-		filePath: filePath,
+// closeOpened closes the output files opened so far by NewFileWriter when it
+// fails: the shards, the memory mapping, then the output file
+func (fw *FileWriter) closeOpened() {
+	fw.closeShards()
+	if fw.mmap != nil {
+		if err := fw.mmap.Close(); err != nil {
+			log.Printf("Error closing output file: %v", err)
+		}
+	}
+	fw.file.Close()
+}
+
+// WriteMessage appends a message received on topic to the output file in the format: <date>|<field>=<value>...
+// where fields are the output fields (name and rssi by default) followed by extra fields
+func (fw *FileWriter) WriteMessage(topic string, payload map[string]any, outputFields []string, extra ...field) error {
+	var fields []field
+
+	// Add each output field if present, or as configured by missing_field
+	for _, name := range outputFields {
+		if value, ok := payload[name]; ok {
+			fields = append(fields, field{key: name, value: value})
+			continue
+		}
+		switch fw.missingField {
+		case missingFieldNull:
+			// Line protocol has no null, the field is omitted
+			if fw.groups != nil {
+				fields = append(fields, field{key: name, value: nil})
+			} else if fw.format != outputFormatInflux {
+				fields = append(fields, field{key: name, value: "null"})
+			}
+		case missingFieldEmpty:
+			fields = append(fields, field{key: name, value: ""})
+		}
+	}
+	fields = append(fields, extra...)
+
+	t := fw.recordTime()
+	fields = append(fields, timeFields(t, fw.timeFields)...)
+
+	if fw.grpc != nil {
+		fw.forwardMessage(topic, t, fields)
+	}
+	if fw.stream != nil {
+		fw.publishMessage(t, topic, fields)
+	}
+
+	if fw.state != nil {
+		fw.setState(topic, fw.messageRecord(t, topic, fields))
+	}
+
+	if fw.groups != nil {
+		fw.groupMessage(topic, payload, fw.messageRecord(t, topic, fields))
+		fw.recorded.Add(1)
+		return nil
+	}
+
+	// Timeseries points only hold the output fields, written in order as
+	// each is encoded from the previous point of its series
+	if fw.ts != nil {
+		fw.ts.mu.Lock()
+		defer fw.ts.mu.Unlock()
+		fw.recorded.Add(1)
+		return fw.writeLines(fw.ts.encode(topic, outputFields, payload, t))
+	}
+
+	if fw.canonical && fw.format != outputFormatMsgpack {
+		var err error
+		if fields, err = canonicalFields(fields); err != nil {
+			return err
+		}
+	}
+
+	var line string
+	if fw.format == outputFormatInflux {
+		var err error
+		if line, err = fw.influxRecord(fw.measurement, topic, fields); err != nil {
+			return err
+		}
+	} else if fw.format == outputFormatMsgpack {
+		record := fw.messageRecord(t, topic, fields)
+		if fw.envelope == nil {
+			record["topic"] = topic
+		}
+		var err error
+		if line, err = msgpackFrame(record, fw.canonical); err != nil {
+			return err
+		}
+	} else {
+		// Build the output line: <date>|name=<name>|rssi=<rssi>
+		line = t.Format(time.RFC3339)
+		for _, f := range fields {
+			line += fmt.Sprintf("|%s=%v", f.key, f.value)
+		}
+		line += fw.trailer()
+	}
+
+	if fw.sortBy != "" || fw.latest != nil {
+		at, ok := payloadTime(payload[fw.sortBy])
+		if !ok {
+			at = time.Now()
+		}
+
+		fw.mu.Lock()
+		defer fw.mu.Unlock()
+		// When downsampling, a message replaces the pending one of its topic
+		if fw.latest != nil {
+			if i, ok := fw.latest[topic]; ok {
+				fw.batch[i] = batchedLine{at: at, line: line}
+				downsampledMessages.Inc()
+				return nil
+			}
+			fw.latest[topic] = len(fw.batch)
+		}
+		fw.batch = append(fw.batch, batchedLine{at: at, line: line})
+		fw.recorded.Add(1)
+		return nil
+	}
+
+	fw.recorded.Add(1)
+	return fw.writeShardLines(fw.shardOf(topic, payload), line)
+}
+
+// WriteBinary appends a binary message to the output file in the format: <date>|topic=<topic>|size=<size>|preview=<hex>
+func (fw *FileWriter) WriteBinary(topic string, payload []byte) error {
+	preview := payload
+	if len(preview) > binaryPreviewSize {
+		preview = preview[:binaryPreviewSize]
+	}
+
+	if fw.grpc != nil {
+		fw.grpc.Send(grpcRecord(topic, fw.recordTime(), payload, true, fw.sessionID, fw.brokerLabel()))
+	}
+	if fw.stream != nil {
+		fw.publishMessage(fw.recordTime(), topic, []field{
+			{key: "size", value: len(payload)},
+			{key: "preview", value: hex.EncodeToString(preview)},
+		})
+	}
+
+	if fw.groups != nil {
+		fw.groupMessage(topic, nil, fw.messageRecord(fw.recordTime(), topic, []field{
+			{key: "size", value: len(payload)},
+			{key: "preview", value: hex.EncodeToString(preview)},
+		}))
+		fw.recorded.Add(1)
+		return nil
+	}
+
+	var line string
+	if fw.format == outputFormatInflux {
+		var err error
+		line, err = fw.influxRecord(fw.measurement+"_binary", topic, []field{
+			{key: "size", value: len(payload)},
+			{key: "preview", value: hex.EncodeToString(preview)},
+		})
+		if err != nil {
+			return err
+		}
+	} else if fw.format == outputFormatMsgpack {
+		record := fw.messageRecord(fw.recordTime(), topic, []field{
+			{key: "topic", value: topic},
+			{key: "size", value: len(payload)},
+			{key: "preview", value: hex.EncodeToString(preview)},
+		})
+		var err error
+		if line, err = msgpackFrame(record, fw.canonical); err != nil {
+			return err
+		}
+	} else {
+		line = fmt.Sprintf("%s|topic=%s|size=%d|preview=%s",
+			fw.recordTime().Format(time.RFC3339), topic, len(payload), hex.EncodeToString(preview))
+		line += fw.trailer()
+	}
+
+	fw.recorded.Add(1)
+	return fw.writeShardLines(fw.shardOf(topic, nil), line)
+}
+
+// influxRecord formats a record of topic as line protocol, with the topic,
+// session ID and broker as tags and the monotonic time as an extra field
+func (fw *FileWriter) influxRecord(measurement, topic string, fields []field) (string, error) {
+	tags := []field{{key: "topic", value: topic}}
+	if fw.sessionID != "" {
+		tags = append(tags, field{key: "session_id", value: fw.sessionID})
+	}
+	if broker := fw.brokerLabel(); broker != "" {
+		tags = append(tags, field{key: "broker", value: broker})
 	}
+	if fw.monotonicField != "" {
+		fields = append(fields, field{key: fw.monotonicField, value: time.Since(fw.start).Seconds()})
+	}
+	return influxLine(measurement, tags, fields, fw.recordTime())
+}
+
+// now returns the current time in the configured timezone
+func (fw *FileWriter) now() time.Time {
+	return time.Now().In(fw.location)
 }
 
-// WriteMessage appends a message to the output file in the format: <date>|name=<name>|rssi=<rssi>
-func (fw *FileWriter) WriteMessage(payload map[string]any) error {
+// recordTime returns the time a message is recorded with, truncated if configured
+func (fw *FileWriter) recordTime() time.Time {
+	t := fw.now()
+	if fw.truncate > 0 {
+		// time.Truncate works on absolute time, shift by the zone offset so
+		// that boundaries fall on the local wall clock
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+		t = t.Add(shift).Truncate(fw.truncate).Add(-shift)
+	}
+	return t
+}
+
+// brokerLabel returns the broker label of the records, empty if disabled
+func (fw *FileWriter) brokerLabel() string {
+	label, _ := fw.broker.Load().(string)
+	return label
+}
+
+// SetBroker changes the broker label of the next records, e.g. after a failover
+func (fw *FileWriter) SetBroker(label string) {
+	fw.broker.Store(label)
+}
+
+// trailer returns the fields ending every record: the session ID, the broker
+// and the monotonic time since startup, if enabled
+func (fw *FileWriter) trailer() string {
+	var trailer string
+	if fw.sessionID != "" {
+		trailer += "|session_id=" + fw.sessionID
+	}
+	if broker := fw.brokerLabel(); broker != "" {
+		trailer += "|broker=" + broker
+	}
+	if fw.monotonicField != "" {
+		trailer += fmt.Sprintf("|%s=%.6f", fw.monotonicField, time.Since(fw.start).Seconds())
+	}
+	return trailer
+}
+
+// Files returns the output files written to so far, and the index file if any
+func (fw *FileWriter) Files() []string {
 	fw.mu.Lock()
 	defer fw.mu.Unlock()
 
-	// Open file in append mode, create if it doesn't exist
-	file, err := os.OpenFile(fw.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open output file: %w", err)
+	files := append([]string(nil), fw.files...)
+	if fw.index != nil {
+		files = append(files, fw.index.path)
+	}
+	return files
+}
+
+// Recorded returns the number of messages recorded so far
+func (fw *FileWriter) Recorded() uint64 {
+	return fw.recorded.Load()
+}
+
+// WriteEvent appends a non-message event to the output file in the format: <date>|event=<name>|<key>=<value>...
+func (fw *FileWriter) WriteEvent(name string, fields map[string]string) error {
+	// Timeseries files only hold the output fields of messages
+	if fw.ts != nil || fw.paused.Load() {
+		return nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if fw.groups != nil || fw.format == outputFormatMsgpack {
+		record := map[string]any{"time": fw.now().Format(time.RFC3339), "event": name}
+		for key, value := range fields {
+			record[key] = value
+		}
+		if fw.groups != nil {
+			fw.group(groupedEventsKey, record)
+			return nil
+		}
+		frame, err := msgpackFrame(record, fw.canonical)
+		if err != nil {
+			return err
+		}
+		return fw.writeLines(frame)
 	}
-	defer file.Close()
 
-	// Build the output line: <date>|name=<name>|rssi=<rssi>
-	date := time.Now().Format(time.RFC3339)
-	line := date
+	if fw.format == outputFormatInflux {
+		values := make([]field, len(keys))
+		for i, key := range keys {
+			values[i] = field{key: key, value: fields[key]}
+		}
+		line, err := influxLine(fw.measurement+"_event", []field{{key: "event", value: name}}, values, fw.now())
+		if err != nil {
+			return err
+		}
+		return fw.writeLines(line)
+	}
 
-	// Add name if present
-	if name, ok := payload["name"]; ok {
-		line += fmt.Sprintf("|name=%v", name)
+	line := fw.now().Format(time.RFC3339) + "|event=" + name
+	for _, key := range keys {
+		line += fmt.Sprintf("|%s=%s", key, fields[key])
 	}
 
-	// Add rssi if present
-	if rssi, ok := payload["rssi"]; ok {
-		line += fmt.Sprintf("|rssi=%v", rssi)
+	return fw.writeLines(line)
+}
+
+// Paused reports whether recording is paused
+func (fw *FileWriter) Paused() bool {
+	return fw.paused.Load()
+}
+
+// SetPaused pauses or resumes recording
+func (fw *FileWriter) SetPaused(paused bool) {
+	fw.paused.Store(paused)
+}
+
+// Flush writes the pending batch to the output file, sorted by time, then flushes the write buffer
+func (fw *FileWriter) Flush() error {
+	// Only the acknowledgments registered so far are for lines this flush
+	// is guaranteed to write
+	fw.mu.Lock()
+	acks := fw.pendingAcks
+	fw.pendingAcks = nil
+	recorded := fw.recorded.Load()
+	fw.mu.Unlock()
+
+	if err := fw.flushBatch(); err != nil {
+		fw.requeueAcks(acks)
+		return err
 	}
 
-	// Write line with newline
-	line += "\n"
-	if _, err := file.WriteString(line); err != nil {
-		return fmt.Errorf("failed to write to file: %w", err)
+	fw.mu.Lock()
+	if fw.buf != nil {
+		if err := fw.buf.Flush(); err != nil {
+			fw.accountWrite(err)
+			fw.mu.Unlock()
+			fw.requeueAcks(acks)
+			return fmt.Errorf("failed to flush output file: %w", err)
+		}
 	}
+	for _, shard := range fw.shards {
+		if shard.buf == nil || shard.buf == fw.buf {
+			continue
+		}
+		if err := shard.buf.Flush(); err != nil {
+			fw.accountWrite(err)
+			fw.mu.Unlock()
+			fw.requeueAcks(acks)
+			return fmt.Errorf("failed to flush output file: %w", err)
+		}
+	}
+	if fw.mmap != nil {
+		if err := fw.mmap.Flush(); err != nil {
+			fw.accountWrite(err)
+			fw.mu.Unlock()
+			fw.requeueAcks(acks)
+			return err
+		}
+	}
+	// Until the gzip stream is flushed, the lines are not in the file yet
+	written := true
+	if fw.gzip != nil {
+		if time.Since(fw.gzipFlushed) < fw.gzipFlushInterval {
+			written = false
+		} else if err := fw.flushGzip(); err != nil {
+			fw.mu.Unlock()
+			fw.requeueAcks(acks)
+			return err
+		}
+	}
+	if fw.groups != nil {
+		if err := fw.writeGrouped(); err != nil {
+			fw.mu.Unlock()
+			fw.requeueAcks(acks)
+			return err
+		}
+	}
+	if fw.window != nil {
+		clear(fw.window)
+	}
+	fw.mu.Unlock()
 
+	if !written {
+		fw.requeueAcks(acks)
+		return nil
+	}
+	fw.flushed.Store(recorded)
+	for _, ack := range acks {
+		ack()
+	}
 	return nil
 }
 
-// messageHandler handles incoming MQTT messages
-func messageHandler(writer *FileWriter) mqtt.MessageHandler {
-	return func(client mqtt.Client, msg mqtt.Message) {
-		var payload map[string]any
-		if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
-			log.Printf("Error unmarshaling message from topic %s: %v", msg.Topic(), err)
-			return
+// accountWrite counts consecutive write errors, reporting the failure of the
+// writer once there are too many of them. The caller must hold fw.mu.
+func (fw *FileWriter) accountWrite(err error) {
+	if err == nil {
+		fw.writeErrors = 0
+		return
+	}
+
+	fw.writeErrors++
+	if fw.writeErrors == fw.maxWriteErrors {
+		// A later streak of errors reaches the limit again
+		fw.failOnce.Do(func() { close(fw.failed) })
+	}
+}
+
+// Failed is closed once max_consecutive_write_errors writes in a row failed
+func (fw *FileWriter) Failed() <-chan struct{} {
+	return fw.failed
+}
+
+// Redelivered reports whether a message with the same key was already
+// received during the current flush window, and remembers the key otherwise
+func (fw *FileWriter) Redelivered(key [sha256.Size]byte) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if _, ok := fw.window[key]; ok {
+		return true
+	}
+	fw.window[key] = struct{}{}
+	return false
+}
+
+// AckWhenWritten calls ack once the last recorded message is written to the
+// output file: immediately if writes are neither buffered nor batched, or
+// after the next flush otherwise. Acknowledgments are only deferred while at
+// least ackThreshold messages wait to be written.
+func (fw *FileWriter) AckWhenWritten(ack func()) {
+	fw.mu.Lock()
+	if !fw.holdsLines() || fw.recorded.Load()-fw.flushed.Load() < uint64(fw.ackThreshold) {
+		fw.mu.Unlock()
+		ack()
+		return
+	}
+	fw.pendingAcks = append(fw.pendingAcks, ack)
+	fw.mu.Unlock()
+}
+
+// holdsLines tells whether the recorded messages can wait in memory before
+// reaching the output file: in a write buffer, the shards' included, an mmap
+// region, a gzip stream, the grouped records or a sorted or downsampled
+// batch. Ring files and unbuffered shards are written as messages come.
+func (fw *FileWriter) holdsLines() bool {
+	if fw.buf != nil || fw.mmap != nil || fw.gzip != nil || fw.groups != nil || fw.sortBy != "" || fw.latest != nil {
+		return true
+	}
+	for _, shard := range fw.shards {
+		if shard.buf != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// requeueAcks puts back acknowledgments whose lines failed to be flushed, they are retried on the next flush
+func (fw *FileWriter) requeueAcks(acks []func()) {
+	fw.mu.Lock()
+	fw.pendingAcks = append(acks, fw.pendingAcks...)
+	fw.mu.Unlock()
+}
+
+// flushBatch writes the pending batch, sorted by time
+func (fw *FileWriter) flushBatch() error {
+	fw.mu.Lock()
+	batch := fw.batch
+	fw.batch = nil
+	if fw.latest != nil {
+		clear(fw.latest)
+	}
+	fw.mu.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	// Only the current batch is sorted, records already written are
+	// never reordered
+	sort.SliceStable(batch, func(i, j int) bool {
+		return batch[i].at.Before(batch[j].at)
+	})
+
+	lines := make([]string, len(batch))
+	for i, b := range batch {
+		lines[i] = b.line
+	}
+
+	return fw.writeLines(lines...)
+}
+
+// Close stops the flush loop, writes any pending data and closes the output file
+func (fw *FileWriter) Close() error {
+	// Day switches from here on don't add to fw.wg while it is waited for
+	fw.mu.Lock()
+	fw.closing = true
+	fw.mu.Unlock()
+	close(fw.done)
+	fw.wg.Wait()
+
+	if fw.grpc != nil {
+		if err := fw.grpc.Close(); err != nil {
+			log.Printf("Error closing gRPC connection: %v", err)
 		}
+	}
+	// Once flushed, the first shard being the output file closed below
+	defer fw.closeShards()
 
-		if err := writer.WriteMessage(payload); err != nil {
-			log.Printf("Error saving message: %v", err)
+	if err := fw.Flush(); err != nil {
+		fw.file.Close()
+		return err
+	}
+	if fw.gzip != nil {
+		// Closing writes the gzip trailer, completing the file
+		if err := fw.gzip.Close(); err != nil {
+			fw.file.Close()
+			return fmt.Errorf("failed to close gzip stream: %w", err)
+		}
+	}
+	if fw.mmap != nil {
+		if err := fw.mmap.Close(); err != nil {
+			fw.file.Close()
+			return err
+		}
+	}
+	if fw.index != nil {
+		if err := fw.index.save(); err != nil {
+			log.Printf("Error saving index file: %v", err)
+		}
+	}
+	if fw.state != nil {
+		if err := fw.WriteState(); err != nil {
+			log.Printf("Error saving state file: %v", err)
+		}
+	}
+	return fw.file.Close()
+}
+
+// flushGzip writes the compressed data held by the gzip stream to the file,
+// with a sync flush: the file is then valid up to there, without a trailer.
+// The caller must hold fw.mu.
+func (fw *FileWriter) flushGzip() error {
+	err := fw.gzip.Flush()
+	fw.accountWrite(err)
+	if err != nil {
+		return fmt.Errorf("failed to flush gzip stream: %w", err)
+	}
+	fw.gzipFlushed = time.Now()
+	return nil
+}
+
+// flushLoop periodically flushes pending data until the writer is closed
+func (fw *FileWriter) flushLoop(interval time.Duration) {
+	defer fw.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := fw.Flush(); err != nil {
+				log.Printf("Error flushing output file: %v", err)
+			}
+		case <-fw.done:
 			return
 		}
+	}
+}
 
-		log.Printf("Received message on topic %s", msg.Topic())
+// writeLines appends lines to the output file, to all its shards if sharded
+func (fw *FileWriter) writeLines(lines ...string) error {
+	return fw.writeShardLines(-1, lines...)
+}
+
+// writeShardLines appends lines to an output shard, or to all of them if
+// shard is -1
+func (fw *FileWriter) writeShardLines(shard int, lines ...string) (err error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	defer func() {
+		fw.accountWrite(err)
+	}()
+
+	if fw.daily {
+		if err := fw.switchDay(); err != nil {
+			return err
+		}
+	}
+
+	var out io.Writer = fw.file
+	if fw.buf != nil {
+		out = fw.buf
+	} else if fw.gzip != nil {
+		out = fw.gzip
+	} else if fw.mmap != nil {
+		out = fw.mmap
+	} else if fw.ring != nil {
+		out = fw.ring
+	}
+	outs := []io.Writer{out}
+	if fw.shards != nil {
+		outs = outs[:0]
+		for i, s := range fw.shards {
+			if shard < 0 || shard == i {
+				outs = append(outs, s.writer())
+			}
+		}
+	}
+
+	// Write each line with newline, MessagePack frames and timeseries
+	// records are written as is
+	newline := "\n"
+	if fw.format == outputFormatMsgpack || fw.format == outputFormatTimeseries {
+		newline = ""
+	}
+	for _, line := range lines {
+		for _, out := range outs {
+			if _, err := io.WriteString(out, line+newline); err != nil {
+				return fmt.Errorf("failed to write to file: %w", err)
+			}
+		}
+		if fw.index != nil {
+			fw.index.observe(fw.file.Name(), line)
+		}
 	}
+
+	return nil
 }
 
 // loadConfig loads configuration from file using Viper
@@ -99,85 +1262,964 @@ func loadConfig(configPath string) (*Config, error) {
 
 	// Set defaults
 	viper.SetDefault("mqtt.port", 1883)
+	viper.SetDefault("mqtt.default_publish_handler", false)
+	viper.SetDefault("mqtt.resubscribe_qos", resubscribeGranted)
+	viper.SetDefault("mqtt.failover_after", 3)
 	viper.SetDefault("output_file", "mqtt-trace.log")
+	viper.SetDefault("flush_interval", "1s")
+	viper.SetDefault("on_existing", onExistingAppend)
+	viper.SetDefault("timezone", "Local")
+	viper.SetDefault("output_fields", []string{"name", "rssi"})
+	viper.SetDefault("on_shape_mismatch", shapeMismatchRecord)
+	viper.SetDefault("control_chars", controlCharsAllow)
+	viper.SetDefault("on_type_mismatch", typeMismatchRecord)
+	viper.SetDefault("checksum.algorithm", checksumCRC32)
+	viper.SetDefault("checksum.on_failure", checksumFailureFlag)
+	viper.SetDefault("threshold_alerts.record", true)
+	viper.SetDefault("missing_field", missingFieldOmit)
+	viper.SetDefault("rename_collision", renameCollisionError)
+	viper.SetDefault("normalize_order", normalizeBeforeRename)
+	viper.SetDefault("promote_mode", promoteModeCopy)
+	viper.SetDefault("promote_collision", renameCollisionError)
+	viper.SetDefault("timestamp.on_future", futureTimestampFlag)
+	viper.SetDefault("tls.expiry_warn_days", 30)
+	viper.SetDefault("tls.min_version", "1.2")
+	viper.SetDefault("heartbeat.interval", "1m")
+	viper.SetDefault("status_interval", "1m")
+	viper.SetDefault("jitter_stats.interval", "1m")
+	viper.SetDefault("quality_score.interval", "1m")
+	viper.SetDefault("quality_score.gap", "30s")
+	viper.SetDefault("output_type", outputTypeFile)
+	viper.SetDefault("shard_key", shardKeyTopic)
+	viper.SetDefault("output_format", outputFormatLine)
+	viper.SetDefault("group_by", groupByTopic)
+	viper.SetDefault("group_default", "_ungrouped")
+	viper.SetDefault("influx_measurement", "mqtt")
+	viper.SetDefault("output_escape_html", true)
+	viper.SetDefault("mmap_size", 16<<20)
+	viper.SetDefault("ring_size", 16<<20)
+	viper.SetDefault("output_compression", compressionNone)
+	viper.SetDefault("gzip_flush_interval", "10s")
+	viper.SetDefault("distinct_payloads.lru_size", 10000)
+	viper.SetDefault("dedup_lru_size", 10000)
+	viper.SetDefault("catch_up.window", "30s")
+	viper.SetDefault("state_interval", "10s")
+	viper.SetDefault("discovery.fields", []string{"state_topic"})
+	viper.SetDefault("catch_up.gap", "1s")
+	viper.SetDefault("grpc.buffer", 10000)
+	viper.SetDefault("event_webhook.timeout", "10s")
+	viper.SetDefault("event_webhook.max_retries", 3)
+	viper.SetDefault("stream.buffer", 256)
+	viper.SetDefault("stream.on_slow_client", slowClientDrop)
 
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
 	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	var metadata mapstructure.Metadata
+	if err := viper.Unmarshal(&config, func(dc *mapstructure.DecoderConfig) {
+		dc.Metadata = &metadata
+		dc.DecodeHook = mapstructure.ComposeDecodeHookFunc(
+			topicConfigHook,
+			// Viper's default hooks
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		)
+	}); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	// Viper silently ignores keys that don't map to the Config struct, which
+	// usually means a typo
+	if len(metadata.Unused) > 0 {
+		sort.Strings(metadata.Unused)
+		if config.StrictConfig {
+			return nil, fmt.Errorf("unknown config keys: %s", strings.Join(metadata.Unused, ", "))
+		}
+		log.Printf("WARNING: ignoring unknown config keys: %s", strings.Join(metadata.Unused, ", "))
+	}
+
 	// Validate required fields
 	if config.MQTT.Broker == "" {
 		return nil, fmt.Errorf("mqtt.broker is required")
 	}
-	if len(config.MQTT.Topics) == 0 {
+	if len(config.MQTT.Topics) == 0 && config.Discovery.Topic == "" {
 		return nil, fmt.Errorf("at least one mqtt.topic is required")
 	}
+	if config.Discovery.Topic != "" && len(config.Discovery.Fields) == 0 {
+		return nil, fmt.Errorf("discovery.fields is required with discovery.topic")
+	}
+	for i, topic := range config.MQTT.Topics {
+		if topic.Topic == "" {
+			return nil, fmt.Errorf("mqtt.topics[%d]: topic is required", i)
+		}
+		if err := validateTopicFilter(topic.Topic); err != nil {
+			return nil, fmt.Errorf("mqtt.topics[%d]: %w", i, err)
+		}
+		if topic.QoS != nil && *topic.QoS > 2 {
+			return nil, fmt.Errorf("mqtt.topics[%d]: qos must be 0, 1 or 2", i)
+		}
+		if topic.SampleRatio != nil && (*topic.SampleRatio < 0 || *topic.SampleRatio > 1) {
+			return nil, fmt.Errorf("mqtt.topics[%d]: sample_ratio must be between 0 and 1", i)
+		}
+	}
+	if config.MQTT.ReadBuffer < 0 || config.MQTT.ReadBuffer > maxSocketBuffer {
+		return nil, fmt.Errorf("mqtt.read_buffer must be between 0 and %d", maxSocketBuffer)
+	}
+	if config.MQTT.WriteBuffer < 0 || config.MQTT.WriteBuffer > maxSocketBuffer {
+		return nil, fmt.Errorf("mqtt.write_buffer must be between 0 and %d", maxSocketBuffer)
+	}
+	if config.MQTT.MaxInflight < 0 {
+		return nil, fmt.Errorf("mqtt.max_inflight must not be negative")
+	}
+	if config.MQTT.ManualAckThreshold < 0 {
+		return nil, fmt.Errorf("mqtt.manual_ack_threshold must not be negative")
+	}
+	if config.MQTT.ResubscribeQoS != resubscribeGranted && config.MQTT.ResubscribeQoS != resubscribeRequested {
+		return nil, fmt.Errorf("mqtt.resubscribe_qos must be granted or requested")
+	}
+	if config.TLS.CADir != "" {
+		if _, err := os.ReadDir(config.TLS.CADir); err != nil {
+			return nil, fmt.Errorf("tls.ca_dir is not readable: %w", err)
+		}
+	}
+	if len(config.MQTT.FailoverBrokers) > 0 {
+		if config.MQTT.FailoverAfter < 1 {
+			return nil, fmt.Errorf("mqtt.failover_after must be at least 1")
+		}
+		brokers, err := failoverBrokers(config.MQTT.Broker, config.MQTT.Port, config.MQTT.FailoverBrokers)
+		if err != nil {
+			return nil, err
+		}
+		config.MQTT.Brokers = brokers
+	}
+	if config.MQTT.StartupBuffer < 0 {
+		return nil, fmt.Errorf("mqtt.startup_buffer must not be negative")
+	}
+	if config.MQTT.QoS > 2 {
+		return nil, fmt.Errorf("mqtt.qos must be 0, 1 or 2")
+	}
+	if config.MQTT.Birth.Topic != "" && config.MQTT.Birth.QoS > 2 {
+		return nil, fmt.Errorf("mqtt.birth.qos must be 0, 1 or 2")
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return nil, fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	if _, ok := tlsVersions[config.TLS.MinVersion]; !ok {
+		return nil, fmt.Errorf("tls.min_version must be one of 1.2 or 1.3")
+	}
+	if config.Heartbeat.Enabled && config.Heartbeat.Interval <= 0 {
+		return nil, fmt.Errorf("heartbeat.interval must be positive")
+	}
+	switch config.OnExisting {
+	case onExistingAppend, onExistingTruncate, onExistingFail, onExistingTimestamp:
+	default:
+		return nil, fmt.Errorf("on_existing must be one of append, truncate, fail or timestamp")
+	}
+	for i, r := range config.RenameFields {
+		if r.From == "" || r.To == "" {
+			return nil, fmt.Errorf("rename_fields[%d]: from and to are required", i)
+		}
+	}
+	switch config.RenameCollision {
+	case renameCollisionError, renameCollisionFirstWins, renameCollisionLastWins, renameCollisionSuffix:
+	default:
+		return nil, fmt.Errorf("rename_collision must be one of error, first-wins, last-wins or suffix")
+	}
+	switch config.NormalizeKeys {
+	case "", normalizeKeysLower, normalizeKeysUpper, normalizeKeysSnake:
+	default:
+		return nil, fmt.Errorf("normalize_keys must be one of lower, upper or snake")
+	}
+	switch config.NormalizeOrder {
+	case normalizeBeforeRename, normalizeAfterRename:
+	default:
+		return nil, fmt.Errorf("normalize_order must be one of before-rename or after-rename")
+	}
+	for i, path := range config.PromoteFields {
+		if !strings.Contains(path, ".") || strings.Contains(path, "..") || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") {
+			return nil, fmt.Errorf("promote_fields[%d]: %q is not the dotted path of a nested field", i, path)
+		}
+	}
+	switch config.PromoteMode {
+	case promoteModeCopy, promoteModeMove:
+	default:
+		return nil, fmt.Errorf("promote_mode must be one of copy or move")
+	}
+	switch config.PromoteCollision {
+	case renameCollisionError, renameCollisionFirstWins, renameCollisionLastWins, renameCollisionSuffix:
+	default:
+		return nil, fmt.Errorf("promote_collision must be one of error, first-wins, last-wins or suffix")
+	}
+	switch config.MissingField {
+	case missingFieldOmit, missingFieldNull, missingFieldEmpty:
+	default:
+		return nil, fmt.Errorf("missing_field must be one of omit, null or empty")
+	}
+	switch config.OnShapeMismatch {
+	case shapeMismatchRecord, shapeMismatchDrop, shapeMismatchFlag:
+	default:
+		return nil, fmt.Errorf("on_shape_mismatch must be one of record, drop or flag")
+	}
+	switch config.OnTypeMismatch {
+	case typeMismatchRecord, typeMismatchFlag, typeMismatchDrop, typeMismatchCoerce:
+	default:
+		return nil, fmt.Errorf("on_type_mismatch must be one of record, flag, drop or coerce")
+	}
+	if config.Checksum.Field != "" {
+		if newChecksumHash(config.Checksum.Algorithm) == nil {
+			return nil, fmt.Errorf("checksum.algorithm must be one of crc32, crc32c, md5 or sha256")
+		}
+		switch config.Checksum.OnFailure {
+		case checksumFailureFlag, checksumFailureDrop:
+		default:
+			return nil, fmt.Errorf("checksum.on_failure must be flag or drop")
+		}
+		if slices.Contains(config.Checksum.Fields, config.Checksum.Field) {
+			return nil, fmt.Errorf("checksum.fields can't hold the checksum field %s", config.Checksum.Field)
+		}
+	}
+	// Configuration keys are case-insensitive, so are the field names of
+	// field_types: map them back to the output fields
+	fieldTypes := make(map[string]string, len(config.FieldTypes))
+	for name, typ := range config.FieldTypes {
+		switch typ {
+		case fieldTypeNumber, fieldTypeString, fieldTypeBool:
+		default:
+			return nil, fmt.Errorf("field_types.%s must be one of number, string or bool", name)
+		}
+		i := slices.IndexFunc(config.OutputFields, func(field string) bool { return strings.EqualFold(field, name) })
+		if i < 0 {
+			return nil, fmt.Errorf("field_types.%s is not one of output_fields", name)
+		}
+		fieldTypes[config.OutputFields[i]] = typ
+	}
+	config.FieldTypes = fieldTypes
+	for i, t := range config.Thresholds {
+		if t.Field == "" {
+			return nil, fmt.Errorf("thresholds[%d].field is required", i)
+		}
+		if t.Below == nil && t.Above == nil {
+			return nil, fmt.Errorf("thresholds[%d] needs below or above", i)
+		}
+		if t.Below != nil && t.Above != nil && *t.Below+t.Hysteresis > *t.Above-t.Hysteresis {
+			return nil, fmt.Errorf("thresholds[%d].below and above leave no room for the hysteresis", i)
+		}
+		if t.Hysteresis < 0 {
+			return nil, fmt.Errorf("thresholds[%d].hysteresis must not be negative", i)
+		}
+	}
+	switch config.ControlChars {
+	case controlCharsAllow, controlCharsSanitize, controlCharsReject:
+	default:
+		return nil, fmt.Errorf("control_chars must be one of allow, sanitize or reject")
+	}
+	if config.Stream.Listen != "" {
+		if config.Stream.Buffer <= 0 {
+			return nil, fmt.Errorf("stream.buffer must be positive")
+		}
+		if config.Stream.OnSlowClient != slowClientDrop && config.Stream.OnSlowClient != slowClientDisconnect {
+			return nil, fmt.Errorf("stream.on_slow_client must be drop or disconnect")
+		}
+		if config.Stream.Listen == config.Metrics.Listen || (config.Pprof.Enabled && config.Stream.Listen == config.Pprof.Listen) {
+			return nil, fmt.Errorf("stream.listen must differ from metrics.listen and pprof.listen")
+		}
+	}
+	if config.Pprof.Enabled && config.Pprof.Listen == "" {
+		if config.Metrics.Listen == "" {
+			return nil, fmt.Errorf("pprof.listen is required with pprof.enabled, unless metrics.listen is set")
+		}
+		config.Pprof.Listen = config.Metrics.Listen
+	}
+	if config.JitterStats.Enabled && config.JitterStats.Interval <= 0 {
+		return nil, fmt.Errorf("jitter_stats.interval must be positive")
+	}
+	if config.QualityScore.Enabled && (config.QualityScore.Interval <= 0 || config.QualityScore.Gap <= 0) {
+		return nil, fmt.Errorf("quality_score.interval and gap must be positive")
+	}
+	if config.StatusTopic != "" && config.StatusInterval <= 0 {
+		return nil, fmt.Errorf("status_interval must be positive")
+	}
+	// The session ID is only stamped on records when enabled
+	if !config.IncludeSessionID {
+		config.SessionID = ""
+	} else if config.SessionID == "" {
+		id, err := newUUID()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate session ID: %w", err)
+		}
+		config.SessionID = id
+	}
+	if !config.IncludeBroker {
+		config.BrokerLabel = ""
+	} else if config.BrokerLabel == "" {
+		config.BrokerLabel = net.JoinHostPort(config.MQTT.Broker, strconv.Itoa(config.MQTT.Port))
+	}
+
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %w", err)
+	}
+	config.Location = location
+	if len(config.Schedule.Windows) > 0 {
+		config.Schedule.Location = location
+		if config.Schedule.Timezone != "" {
+			if config.Schedule.Location, err = time.LoadLocation(config.Schedule.Timezone); err != nil {
+				return nil, fmt.Errorf("invalid schedule.timezone: %w", err)
+			}
+		}
+		for i := range config.Schedule.Windows {
+			if err := config.Schedule.Windows[i].parse(); err != nil {
+				return nil, fmt.Errorf("schedule.windows[%d]: %w", i, err)
+			}
+		}
+	}
+	if config.Envelope != "" {
+		if config.OutputFormat != outputFormatGrouped && config.OutputFormat != outputFormatMsgpack && config.StateFile == "" {
+			return nil, fmt.Errorf("envelope requires output_format grouped or msgpack, or a state_file")
+		}
+		if config.EnvelopeTemplate, err = parseEnvelope(config.Envelope); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range config.TimeFields {
+		switch name {
+		case timeFieldHour, timeFieldDate, timeFieldWeekday, timeFieldISOWeek, timeFieldMonth:
+		default:
+			return nil, fmt.Errorf("time_fields must be among hour, date, weekday, iso_week and month, got %q", name)
+		}
+	}
+	if config.Timestamp.Truncate < 0 {
+		return nil, fmt.Errorf("timestamp.truncate must not be negative")
+	}
+	if config.Timestamp.Field == "" {
+		config.Timestamp.Field = config.SortBatchBy
+	}
+	if config.Timestamp.MaxClockSkew < 0 {
+		return nil, fmt.Errorf("timestamp.max_clock_skew must not be negative")
+	}
+	if config.Timestamp.MaxClockSkew > 0 && config.Timestamp.Field == "" {
+		return nil, fmt.Errorf("timestamp.max_clock_skew requires timestamp.field or sort_batch_by")
+	}
+	switch config.Timestamp.OnFuture {
+	case futureTimestampFlag, futureTimestampDrop:
+	default:
+		return nil, fmt.Errorf("timestamp.on_future must be one of flag or drop")
+	}
+	if config.CatchUp.Enabled && (config.CatchUp.Window <= 0 || config.CatchUp.Gap <= 0) {
+		return nil, fmt.Errorf("catch_up.window and catch_up.gap must be positive")
+	}
+	if config.DedupLRUSize < 0 {
+		return nil, fmt.Errorf("dedup_lru_size must not be negative")
+	}
+	if config.DistinctPayloads.LRUSize < 0 {
+		return nil, fmt.Errorf("distinct_payloads.lru_size must not be negative")
+	}
+	switch config.OutputType {
+	case outputTypeFile:
+	case outputTypeMmap:
+		if config.DailyFiles {
+			return nil, fmt.Errorf("output_type mmap does not support daily_files")
+		}
+		if config.BufferSize > 0 {
+			return nil, fmt.Errorf("output_type mmap does not use buffer_size, remove it")
+		}
+		if config.MmapSize <= 0 {
+			return nil, fmt.Errorf("mmap_size must be positive")
+		}
+	case outputTypeRing:
+		if config.DailyFiles || config.BufferSize > 0 {
+			return nil, fmt.Errorf("output_type ring can't be combined with daily_files or buffer_size")
+		}
+		if config.RingSize <= 0 || config.RingSize > 1<<40 {
+			return nil, fmt.Errorf("ring_size must be positive and at most 1 TiB")
+		}
+	default:
+		return nil, fmt.Errorf("output_type must be one of file, mmap or ring")
+	}
+	switch config.OutputCompression {
+	case compressionNone:
+	case compressionGzip:
+		if config.OutputType != outputTypeFile || config.OutputFormat == outputFormatGrouped || config.ArchiveDaily {
+			return nil, fmt.Errorf("output_compression gzip can't be combined with output_type mmap or ring, output_format grouped or archive_daily")
+		}
+		if config.GzipFlushInterval <= 0 {
+			return nil, fmt.Errorf("gzip_flush_interval must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("output_compression must be one of none or gzip")
+	}
+	switch config.OutputFormat {
+	case outputFormatLine:
+	case outputFormatInflux:
+		if config.InfluxMeasurement == "" {
+			return nil, fmt.Errorf("influx_measurement is required with output_format influx")
+		}
+		if len(config.OutputFields) == 0 {
+			return nil, fmt.Errorf("output_fields is required with output_format influx")
+		}
+		if config.IndexFile {
+			return nil, fmt.Errorf("index_file is not supported with output_format influx")
+		}
+	case outputFormatGrouped:
+		if config.DailyFiles || config.OutputType != outputTypeFile || config.BufferSize > 0 || config.SortBatchBy != "" || config.Downsample.Interval > 0 {
+			return nil, fmt.Errorf("output_format grouped can't be combined with daily_files, output_type mmap or ring, buffer_size, sort_batch_by or downsample")
+		}
+	case outputFormatMsgpack:
+		if config.OutputType != outputTypeFile || config.IndexFile || config.ArchiveDaily {
+			return nil, fmt.Errorf("output_format msgpack can't be combined with output_type mmap or ring, index_file or archive_daily")
+		}
+	case outputFormatTimeseries:
+		if len(config.OutputFields) == 0 {
+			return nil, fmt.Errorf("output_fields is required with output_format timeseries")
+		}
+		if config.OutputType != outputTypeFile || config.DailyFiles || config.SortBatchBy != "" || config.Downsample.Interval > 0 || len(config.BinaryTopics) > 0 {
+			return nil, fmt.Errorf("output_format timeseries can't be combined with output_type mmap or ring, daily_files, sort_batch_by, downsample or binary_topics")
+		}
+	default:
+		return nil, fmt.Errorf("output_format must be one of line, influx, grouped, msgpack or timeseries")
+	}
+	if config.GroupBy != groupByTopic {
+		if config.OutputFormat != outputFormatGrouped {
+			return nil, fmt.Errorf("group_by requires output_format grouped")
+		}
+		if config.GroupBy == "" {
+			return nil, fmt.Errorf("group_by must be topic or a payload field")
+		}
+		if config.GroupDefault == "" || config.GroupDefault == groupedEventsKey {
+			return nil, fmt.Errorf("group_default must not be empty or %s", groupedEventsKey)
+		}
+	}
+	if config.Shards < 0 {
+		return nil, fmt.Errorf("shards must not be negative")
+	}
+	if config.Shards > 1 {
+		if config.ShardKey == "" {
+			return nil, fmt.Errorf("shard_key must be topic or a payload field")
+		}
+		switch config.OutputFormat {
+		case outputFormatLine, outputFormatInflux, outputFormatMsgpack:
+		default:
+			return nil, fmt.Errorf("shards requires output_format line, influx or msgpack")
+		}
+		if config.OutputType != outputTypeFile || config.OutputCompression != compressionNone || config.DailyFiles || config.SortBatchBy != "" || config.Downsample.Interval > 0 {
+			return nil, fmt.Errorf("shards can't be combined with output_type mmap or ring, output_compression, daily_files, sort_batch_by or downsample")
+		}
+	}
+	if config.IndexFile && !config.DailyFiles {
+		return nil, fmt.Errorf("index_file requires daily_files")
+	}
+	if config.ArchiveDaily && !config.DailyFiles {
+		return nil, fmt.Errorf("archive_daily requires daily_files")
+	}
+	if config.StateFile != "" && config.StateInterval <= 0 {
+		return nil, fmt.Errorf("state_interval must be positive")
+	}
+	if config.EventWebhook.URL != "" {
+		if u, err := url.Parse(config.EventWebhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("event_webhook.url must be an http or https URL")
+		}
+		if config.EventWebhook.Timeout <= 0 {
+			return nil, fmt.Errorf("event_webhook.timeout must be positive")
+		}
+		if config.EventWebhook.MaxRetries < 0 {
+			return nil, fmt.Errorf("event_webhook.max_retries must not be negative")
+		}
+	}
+	if config.Baseline.File != "" {
+		if config.Baseline.ReportFile == "" {
+			return nil, fmt.Errorf("baseline.file requires baseline.report_file")
+		}
+		if config.Baseline.Tolerance < 0 {
+			return nil, fmt.Errorf("baseline.tolerance must not be negative")
+		}
+	}
+	if config.GRPC.Endpoint != "" {
+		if config.GRPC.Buffer <= 0 {
+			return nil, fmt.Errorf("grpc.buffer must be positive")
+		}
+		if (config.GRPC.TLS.CertFile == "") != (config.GRPC.TLS.KeyFile == "") {
+			return nil, fmt.Errorf("grpc.tls.cert_file and grpc.tls.key_file must be set together")
+		}
+	}
+	if config.SummaryInterval < 0 {
+		return nil, fmt.Errorf("summary_interval must not be negative")
+	}
+	if config.MaxTrackedTopics < 0 {
+		return nil, fmt.Errorf("max_tracked_topics must not be negative")
+	}
+	if config.MaxConsecutiveWriteErrors < 0 {
+		return nil, fmt.Errorf("max_consecutive_write_errors must not be negative")
+	}
+	if config.Shutdown.DrainTimeout < 0 {
+		return nil, fmt.Errorf("shutdown.drain_timeout must not be negative")
+	}
+	if config.MaxDuration < 0 {
+		return nil, fmt.Errorf("max_duration must not be negative")
+	}
+	if config.FloatPrecision != nil && *config.FloatPrecision < 0 {
+		return nil, fmt.Errorf("float_precision must not be negative")
+	}
+	if config.MaxPayloadKeys < 0 {
+		return nil, fmt.Errorf("max_payload_keys must not be negative")
+	}
+	if config.MaxFieldLength < 0 {
+		return nil, fmt.Errorf("max_field_length must not be negative")
+	}
+	for name, length := range config.MaxFieldLengths {
+		if length < 0 {
+			return nil, fmt.Errorf("max_field_lengths.%s must not be negative", name)
+		}
+	}
+	if config.BufferSize < 0 {
+		return nil, fmt.Errorf("buffer_size must not be negative")
+	}
+	if config.Downsample.Interval < 0 {
+		return nil, fmt.Errorf("downsample.interval must not be negative")
+	}
+	if config.FlushInterval <= 0 {
+		return nil, fmt.Errorf("flush_interval must be positive")
+	}
 
 	return &config, nil
 }
 
 func main() {
 	// Load configuration
+	args := os.Args[1:]
+	// tail and decode work on an output file, not a configuration
+	if len(args) > 0 && (args[0] == "tail" || args[0] == "decode") {
+		tool := tail
+		if args[0] == "decode" {
+			tool = decode
+		}
+		if err := tool(args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	command := run
+	if len(args) > 0 && args[0] == "selftest" {
+		command = selftest
+		args = args[1:]
+	} else if len(args) > 0 && args[0] == "init" {
+		command = initConfig
+		args = args[1:]
+	}
+
 	configPath := "config.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if len(args) > 0 {
+		configPath = args[0]
+	}
+
+	if err := command(configPath); err != nil {
+		log.Fatal(err)
 	}
+}
 
+// run starts the trace and blocks until it is interrupted
+func run(configPath string) error {
 	config, err := loadConfig(configPath)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		return fmt.Errorf("failed to load configuration: %w", err)
 	}
-
 	log.Printf("Loaded configuration from %s", configPath)
+
+	return trace(config, nil, nil)
+}
+
+// trace records messages until it is interrupted, or stop is closed. If
+// ready is not nil, it is called with the client once subscribed. Returning
+// instead of exiting guarantees the deferred cleanups (e.g. flushing the
+// output file) run on every exit path.
+func trace(config *Config, ready func(mqtt.Client), stop <-chan struct{}) error {
+	var err error
+	if config.Shards > 1 {
+		config.OutputFile, err = resolveShardFiles(config.OutputFile, config.OnExisting, config.Shards)
+	} else if config.DailyFiles {
+		config.OutputFile, err = resolveDailyFile(config.OutputFile, config.OnExisting, time.Now().In(config.Location).Format(time.DateOnly))
+	} else {
+		config.OutputFile, err = resolveOutputFile(config.OutputFile, config.OnExisting)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prepare output file: %w", err)
+	}
+
+	if config.SessionID != "" {
+		log.Printf("Session ID: %s", config.SessionID)
+	}
 	log.Printf("MQTT Broker: %s:%d", config.MQTT.Broker, config.MQTT.Port)
-	log.Printf("Output file: %s", config.OutputFile)
+	if config.DailyFiles {
+		log.Printf("Output file: %s (one file per day)", dailyPath(config.OutputFile, "YYYY-MM-DD"))
+	} else if config.Shards > 1 {
+		log.Printf("Output files: %s to %s, sharded by %s", shardPath(config.OutputFile, 0), shardPath(config.OutputFile, config.Shards-1), config.ShardKey)
+	} else {
+		log.Printf("Output file: %s", config.OutputFile)
+	}
 	log.Printf("Subscribing to %d topics", len(config.MQTT.Topics))
+	if config.MaxTrackedTopics > 0 {
+		log.Printf("Per-topic bookkeeping limited to %d topics", config.MaxTrackedTopics)
+	}
 
 	// Create file writer
-	writer := NewFileWriter(config.OutputFile)
+	writer, err := NewFileWriter(config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := writer.Close(); err != nil {
+			log.Printf("Error flushing output file: %v", err)
+		}
+
+		// Deferred first, so this runs once all the files are closed
+		if config.ArchiveOnExit {
+			path := archivePath(config.OutputFile, time.Now())
+			files := append(writer.Files(), config.DroppedLog, config.ErrorsFile, config.Baseline.ReportFile,
+				config.SummaryFile, config.StateFile, config.AuditFile)
+			if err := writeArchive(path, files); err != nil {
+				log.Printf("Error archiving capture: %v", err)
+				return
+			}
+			log.Printf("Archived capture to %s", path)
+		}
+	}()
+
+	drops, err := NewDropLog(config.DroppedLog)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if total := drops.Total(); total > 0 {
+			log.Printf("Dropped %d messages: %s", total, drops.Summary())
+		}
+		drops.Close()
+	}()
+
+	audit, err := NewAuditLog(config.AuditFile, net.JoinHostPort(config.MQTT.Broker, fmt.Sprint(config.MQTT.Port)))
+	if err != nil {
+		return err
+	}
+	defer audit.Close()
+
+	webhook := NewEventWebhook(config.EventWebhook.URL, config.EventWebhook.Timeout, config.EventWebhook.MaxRetries,
+		net.JoinHostPort(config.MQTT.Broker, fmt.Sprint(config.MQTT.Port)), config.Location)
+	defer webhook.Close()
+
+	// The profiles share the metrics server when on the same address
+	sharedPprof := config.Pprof.Enabled && config.Pprof.Listen == config.Metrics.Listen
+	if config.Metrics.Listen != "" {
+		stopMetrics := startMetricsServer(config.Metrics.Listen, sharedPprof)
+		defer stopMetrics()
+	}
+	if config.Pprof.Enabled && !sharedPprof {
+		stopPprof := startPprofServer(config.Pprof.Listen)
+		defer stopPprof()
+	}
+	if writer.stream != nil {
+		stopStream := startStreamServer(config.Stream.Listen, writer.stream)
+		defer stopStream()
+	}
 
 	// Setup MQTT client options
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", config.MQTT.Broker, config.MQTT.Port))
+	scheme := "tcp"
+	var expiry *CertExpiry
+	if config.TLS.Enabled {
+		expiry = NewCertExpiry(config.TLS.ExpiryWarnDays, config.TLS.ExpiryAlertTopic, config.MQTT.QoS)
+		tlsConfig, err := newTLSConfig(config, writer, expiry)
+		if err != nil {
+			return fmt.Errorf("failed to setup TLS: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+		scheme = "ssl"
+	}
+	var failover *Failover
+	if len(config.MQTT.Brokers) > 0 {
+		// The broker label follows the failovers unless set explicitly
+		followLabel := config.BrokerLabel == config.MQTT.Brokers[0]
+		failover = NewFailover(config.MQTT.Brokers, config.MQTT.FailoverAfter, func(broker string) {
+			if followLabel {
+				writer.SetBroker(broker)
+			}
+			audit.SetBroker(broker)
+			webhook.SetBroker(broker)
+		})
+	}
+	opts.AddBroker(fmt.Sprintf("%s://%s:%d", scheme, config.MQTT.Broker, config.MQTT.Port))
 	opts.SetClientID(fmt.Sprintf("mqtt-trace-%d", time.Now().Unix()))
 	opts.SetUsername(config.MQTT.Username)
 	opts.SetPassword(config.MQTT.Password)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
 	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetAutoAckDisabled(config.MQTT.ManualAck)
+	opts.SetMaxResumePubInFlight(config.MQTT.MaxInflight)
+	var timing *ConnectTiming
+	if config.ConnectTiming {
+		timing = &ConnectTiming{}
+	}
+	if failover != nil {
+		opts.SetCustomOpenConnectionFn(failover.Open(newOpenConnectionFn(config.MQTT.ReadBuffer, config.MQTT.WriteBuffer, timing)))
+	} else if config.MQTT.ReadBuffer > 0 || config.MQTT.WriteBuffer > 0 || timing != nil {
+		opts.SetCustomOpenConnectionFn(newOpenConnectionFn(config.MQTT.ReadBuffer, config.MQTT.WriteBuffer, timing))
+	}
 
-	// Set default message handler
-	opts.SetDefaultPublishHandler(messageHandler(writer))
+	filters := make(map[string]byte, len(config.MQTT.Topics))
+	priorities := make(map[string]int, len(config.MQTT.Topics))
+	for _, topic := range config.MQTT.Topics {
+		filters[topic.Topic] = config.MQTT.QoS
+		if topic.QoS != nil {
+			filters[topic.Topic] = *topic.QoS
+		}
+		priorities[topic.Topic] = topic.Priority
+	}
+	errorLog := NewErrorLog(config.ErrorsFile)
+	defer errorLog.Close()
+
+	baseline, err := LoadBaseline(config.Baseline.File, config.Baseline.ReportFile, config.Baseline.Tolerance)
+	if err != nil {
+		return err
+	}
+	defer baseline.Close()
+
+	var jitter *JitterStats
+	if config.JitterStats.Enabled {
+		jitter = NewJitterStats(config.MaxTrackedTopics)
+		stopJitter := runEvery(config.JitterStats.Interval, func() {
+			jitter.Report(writer)
+		})
+		defer stopJitter()
+	}
+
+	var distinct *DistinctPayloads
+	if config.DistinctPayloads.Enabled {
+		distinct = NewDistinctPayloads(config.DistinctPayloads.LRUSize)
+		defer func() {
+			if repeats := distinct.Repeats(); repeats > 0 {
+				log.Printf("Skipped %d repeated payloads", repeats)
+			}
+		}()
+	}
+
+	var catchUp *CatchUp
+	if config.CatchUp.Enabled {
+		catchUp = NewCatchUp(config.CatchUp.Window, config.CatchUp.Gap)
+	}
+
+	var quality *QualityScore
+	if config.QualityScore.Enabled {
+		quality = NewQualityScore(config.QualityScore.Gap, config.MaxTrackedTopics)
+		stopQuality := runEvery(config.QualityScore.Interval, func() {
+			quality.Report(writer, config.QualityScore.Record)
+		})
+		defer stopQuality()
+	}
+
+	var counts *SubscriptionCounts
+	if config.SummaryFile != "" {
+		counts = NewSubscriptionCounts(config.MQTT.Topics)
+		save := func() {
+			if err := writeSummary(config.SummaryFile, config.Location, writer, drops, counts); err != nil {
+				log.Printf("Error saving summary: %v", err)
+			}
+		}
+		defer func() {
+			save()
+			logIdleSubscriptions(counts)
+		}()
+		if config.SummaryInterval > 0 {
+			stopSummary := runEvery(config.SummaryInterval, save)
+			defer stopSummary()
+		}
+	}
+
+	handler, err := NewHandler(config, writer, drops, errorLog, jitter, distinct, catchUp, quality, counts, baseline)
+	if err != nil {
+		return err
+	}
+	stopReload := startFilterReload(handler, viper.ConfigFileUsed())
+	defer stopReload()
+	stopPause := startPauseToggle(writer)
+	defer stopPause()
+
+	useGranted := config.MQTT.ResubscribeQoS == resubscribeGranted
+	handleMessage := handler.HandleMessage
+	var startup *StartupBuffer
+	if config.MQTT.StartupBuffer > 0 {
+		startup = NewStartupBuffer(handler.HandleMessage, drops, config.MQTT.StartupBuffer)
+		handleMessage = startup.HandleMessage
+	}
+	subs := NewSubscriptions(maps.Clone(filters), priorities, handleMessage, useGranted, audit)
+
+	// Discovered topics are added to subs, the discovery topic itself has
+	// its own handler
+	var discovery *Discovery
+	var discoverySubs *Subscriptions
+	if config.Discovery.Topic != "" {
+		discovery = NewDiscovery(subs, filters, config.Discovery.Fields, config.MQTT.QoS)
+		discoverySubs = NewSubscriptions(map[string]byte{config.Discovery.Topic: config.MQTT.QoS}, nil, discovery.HandleMessage, useGranted, audit)
+	}
+
+	// Subscriptions are lost when reconnecting with a clean session
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if timing != nil {
+			timing.connected()
+		}
+		if catchUp != nil {
+			catchUp.Start()
+		}
+		subs.OnConnect(client)
+		if discoverySubs != nil {
+			discoverySubs.OnConnect(client)
+		}
+		if expiry != nil {
+			expiry.PublishAlert(client)
+		}
+		if birth := config.MQTT.Birth; birth.Topic != "" {
+			publishBirth(client, birth.Topic, birth.Payload, birth.QoS, birth.Retained)
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		subs.OnConnectionLost(client, err)
+		if discoverySubs != nil {
+			discoverySubs.setActive(0)
+		}
+		if quality != nil {
+			quality.ConnectionLost()
+		}
+	})
+
+	// Messages are routed by the per-subscription handlers below. A default
+	// handler on top of them can make some brokers/paho versions process the
+	// same message twice, so it is only set when explicitly enabled.
+	// Until the subscriptions complete, the startup buffer also catches the
+	// messages their handlers are not registered for yet
+	if config.MQTT.DefaultPublishHandler {
+		opts.SetDefaultPublishHandler(handleMessage)
+	} else if startup != nil {
+		opts.SetDefaultPublishHandler(startup.HandleEarly)
+	}
+
+	// Paho retries unresolvable hosts forever, fail fast instead
+	if err := checkBrokerHost(config.MQTT.Broker); err != nil {
+		if !config.MQTT.RetryUnresolved {
+			return err
+		}
+		log.Printf("WARNING: %v, retrying until it resolves", err)
+	}
 
 	// Create and start MQTT client
+	// Connections are retried forever, even when the credentials are refused
+	authFailed := make(chan error, 1)
+	var notifyHandlers []mqtt.ConnectionNotificationHandler
+	if !config.MQTT.RetryOnAuthFailure {
+		notifyHandlers = append(notifyHandlers, authFailureHandler(authFailed))
+	}
+	if failover != nil {
+		notifyHandlers = append(notifyHandlers, failover.Notify)
+	}
+	// After the failover, which sets the broker connected to
+	if audit != nil {
+		notifyHandlers = append(notifyHandlers, audit.Notify)
+	}
+	if webhook != nil {
+		notifyHandlers = append(notifyHandlers, webhook.Notify)
+	}
+	if len(notifyHandlers) > 0 {
+		opts.SetConnectionNotificationHandler(notificationHandlers(notifyHandlers...))
+	}
+
 	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+	logConnectionParams(client.OptionsReader(), config.MQTT.QoS)
+	token := client.Connect()
+	select {
+	case <-token.Done():
+		if token.Error() != nil {
+			return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
+		}
+	case err := <-authFailed:
+		client.Disconnect(0)
+		return fmt.Errorf("broker refused the connection, check the credentials: %w", err)
 	}
+	defer func() {
+		client.Disconnect(250)
+		log.Println("Disconnected from MQTT broker")
+		audit.Record("disconnect", nil)
+		webhook.Post("disconnect", "shutdown")
+	}()
 
 	log.Println("Connected to MQTT broker")
 
 	// Subscribe to all topics
-	for _, topic := range config.MQTT.Topics {
-		if token := client.Subscribe(topic, 0, messageHandler(writer)); token.Wait() && token.Error() != nil {
-			log.Fatalf("Failed to subscribe to topic %s: %v", topic, token.Error())
+	if err := subs.Subscribe(client); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+
+	if discovery != nil {
+		discovery.Start(client)
+		defer discovery.Stop()
+		if err := discoverySubs.Subscribe(client); err != nil {
+			return fmt.Errorf("failed to subscribe to discovery topic: %w", err)
 		}
-		log.Printf("Subscribed to topic: %s", topic)
+	}
+
+	if startup != nil {
+		startup.Release()
+	}
+
+	if config.StateFile != "" {
+		stopState := runEvery(config.StateInterval, func() {
+			if err := writer.WriteState(); err != nil {
+				log.Printf("Error saving state file: %v", err)
+			}
+		})
+		defer stopState()
+	}
+
+	if config.Heartbeat.Enabled {
+		stopHeartbeat := startHeartbeat(client, writer, drops, config.Heartbeat.Interval)
+		defer stopHeartbeat()
+	}
+
+	if config.StatusTopic != "" {
+		stopStatus := startStatusPublisher(client, writer, drops, config.StatusTopic, config.MQTT.QoS, config.StatusInterval)
+		defer stopStatus()
 	}
 
 	// Wait for interrupt signal to gracefully shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	var deadline <-chan time.Time
+	if config.MaxDuration > 0 {
+		deadline = time.After(config.MaxDuration)
+		log.Printf("Stopping after %s", config.MaxDuration)
+	}
+
+	if ready != nil {
+		ready(client)
+	}
+
 	log.Println("MQTT trace started. Press Ctrl+C to stop...")
-	<-sigChan
+	select {
+	case <-sigChan:
+	case <-stop:
+	case <-deadline:
+		log.Println("Maximum duration reached")
+	case <-writer.Failed():
+		log.Println("Shutting down...")
+		return fmt.Errorf("stopping after %d consecutive write errors", config.MaxConsecutiveWriteErrors)
+	case err := <-authFailed:
+		log.Println("Shutting down...")
+		return fmt.Errorf("broker refused to reconnect, check the credentials: %w", err)
+	}
 
 	log.Println("Shutting down...")
-	client.Disconnect(250)
-	log.Println("Disconnected from MQTT broker")
+	// The discovery subscription goes first, so no topic is added meanwhile
+	if config.Shutdown.DrainTimeout > 0 {
+		drainMessages(client, handler, config.Shutdown.DrainTimeout, discoverySubs, subs)
+	}
+	return nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	subscriptionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_trace_subscriptions_active",
+		Help: "Number of topic filters currently subscribed.",
+	})
+	payloadTruncations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_payload_truncations_total",
+		Help: "Number of payloads truncated to max_payload_keys keys.",
+	})
+	fieldTruncations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_field_truncations_total",
+		Help: "Number of payload strings truncated to max_field_length characters.",
+	})
+	typeMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_type_mismatches_total",
+		Help: "Number of output fields not of their type in field_types, after coercion with on_type_mismatch coerce.",
+	})
+	checksumFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_trace_checksum_failures_total",
+		Help: "Number of payloads failing checksum verification, per reason (missing, invalid or mismatch).",
+	}, []string{"reason"})
+	baselineAnomalies = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_trace_baseline_anomalies_total",
+		Help: "Number of deviations of the records from the baseline.file trace, per reason (new_topic, missing_field or out_of_range).",
+	}, []string{"reason"})
+	discoveryDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_discovery_dropped_total",
+		Help: "Number of discovery updates not applied because the queue of pending updates was full.",
+	})
+	grpcSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_grpc_sent_total",
+		Help: "Number of records sent to the grpc.endpoint stream.",
+	})
+	grpcDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_grpc_dropped_total",
+		Help: "Number of records not streamed to grpc.endpoint because grpc.buffer was full.",
+	})
+	grpcStreamErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_grpc_stream_errors_total",
+		Help: "Number of failed attempts to open or keep the grpc.endpoint stream.",
+	})
+	streamClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_trace_stream_clients",
+		Help: "Number of clients connected to the /stream endpoint.",
+	})
+	streamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_stream_dropped_total",
+		Help: "Number of records not sent to a /stream client because its buffer was full.",
+	})
+	recordingPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_trace_paused",
+		Help: "1 while recording is paused with SIGUSR2, 0 otherwise.",
+	})
+	qualityScore = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_trace_quality_score",
+		Help: "Connection quality score from 0 to 100 over the last quality_score.interval.",
+	})
+	thresholdAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_trace_threshold_alerts_total",
+		Help: "Number of threshold alerts raised (state alert) and cleared (state ok).",
+	}, []string{"state"})
+	activeBroker = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_trace_active_broker",
+		Help: "1 for the broker connections are made to with mqtt.failover_brokers, 0 for the others.",
+	}, []string{"broker"})
+	brokerFailovers = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_broker_failovers_total",
+		Help: "Number of switches to the next broker after mqtt.failover_after failed connection attempts.",
+	})
+	downsampledMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_downsampled_total",
+		Help: "Number of messages not recorded because replaced by a later message of their topic (with downsample).",
+	})
+	futureTimestamps = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_future_timestamps_total",
+		Help: "Number of payloads whose timestamp is later than now by more than timestamp.max_clock_skew.",
+	})
+	duplicateIDs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_duplicate_ids_total",
+		Help: "Number of messages not recorded because their dedup_field value was already seen.",
+	})
+	repeatedPayloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mqtt_trace_repeated_payloads_total",
+		Help: "Number of payloads not recorded because already seen (with distinct_payloads).",
+	})
+	brokerCertExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_trace_broker_cert_expiry_seconds",
+		Help: "Time left before the broker certificate expires, as of the last TLS connection.",
+	})
+	connectDuration = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_trace_connect_duration_seconds",
+		Help: "Duration of each phase of the last connection to the broker (with connect_timing).",
+	}, []string{"phase"})
+	evictedTopics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_trace_evicted_topics_total",
+		Help: "Number of topics evicted from per-topic bookkeeping because max_tracked_topics was reached.",
+	}, []string{"tracker"})
+	processingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mqtt_trace_processing_duration_seconds",
+		Help:    "Time spent handling a recorded message, from reception to written (or queued for writing).",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	interarrivalMean = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_trace_interarrival_mean_seconds",
+		Help: "Mean time between two messages of a topic.",
+	}, []string{"topic"})
+	interarrivalStddev = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mqtt_trace_interarrival_stddev_seconds",
+		Help: "Standard deviation of the time between two messages of a topic (jitter).",
+	}, []string{"topic"})
+)
+
+// startMetricsServer serves the Prometheus metrics on addr, and the profiles
+// too if withPprof is set. The returned function stops it.
+func startMetricsServer(addr string, withPprof bool) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Printf("Serving metrics on %s/metrics", addr)
+	if withPprof {
+		handlePprof(mux)
+		log.Printf("Serving profiles on %s/debug/pprof/", addr)
+	}
+	return serveHTTP(addr, mux, "metrics")
+}
+
+// serveHTTP serves mux on addr, what being what is served for the logs. The
+// returned function stops it.
+func serveHTTP(addr string, mux *http.ServeMux, what string) func() {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Error serving %s: %v", what, err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Error stopping %s server: %v", what, err)
+		}
+	}
+}
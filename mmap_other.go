@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapWriter is not available on this platform
+type mmapWriter struct{}
+
+// newMmapWriter always fails, memory-mapped output requires a Unix system
+func newMmapWriter(file *os.File, prealloc int) (*mmapWriter, error) {
+	return nil, errors.New("mmap output is not supported on this platform")
+}
+
+func (mw *mmapWriter) Write(p []byte) (int, error) { return 0, errors.ErrUnsupported }
+
+func (mw *mmapWriter) Flush() error { return errors.ErrUnsupported }
+
+func (mw *mmapWriter) Close() error { return errors.ErrUnsupported }
@@ -0,0 +1,102 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapWriter writes to a file through a shared memory mapping, so writes are
+// plain memory copies instead of system calls. The file is preallocated and
+// grown as needed, then truncated to the written size when closed.
+type mmapWriter struct {
+	file *os.File
+	data []byte
+	size int // number of bytes written, the rest of data is preallocated
+}
+
+// newMmapWriter maps file, preallocating at least prealloc bytes after its current content
+func newMmapWriter(file *os.File, prealloc int) (*mmapWriter, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to map output file: %w", err)
+	}
+
+	mw := &mmapWriter{file: file}
+	if err := mw.remap(int(info.Size()) + prealloc); err != nil {
+		return nil, err
+	}
+
+	// After a crash, the preallocated space is left as zeros at the end of
+	// the file: resume writing after the last line
+	mw.size = bytes.LastIndexByte(mw.data[:info.Size()], '\n') + 1
+
+	return mw, nil
+}
+
+// remap grows the file to capacity bytes and maps it again
+func (mw *mmapWriter) remap(capacity int) error {
+	if mw.data != nil {
+		if err := unix.Munmap(mw.data); err != nil {
+			return fmt.Errorf("failed to unmap output file: %w", err)
+		}
+		mw.data = nil
+	}
+
+	if err := mw.file.Truncate(int64(capacity)); err != nil {
+		return fmt.Errorf("failed to grow output file: %w", err)
+	}
+	data, err := unix.Mmap(int(mw.file.Fd()), 0, capacity, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("failed to map output file: %w", err)
+	}
+	mw.data = data
+
+	return nil
+}
+
+// Write copies p to the mapping, growing it if needed
+func (mw *mmapWriter) Write(p []byte) (int, error) {
+	if mw.size+len(p) > len(mw.data) {
+		capacity := 2 * len(mw.data)
+		for mw.size+len(p) > capacity {
+			capacity *= 2
+		}
+		if err := mw.remap(capacity); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(mw.data[mw.size:], p)
+	mw.size += n
+	return n, nil
+}
+
+// Flush writes the mapped data back to the file
+func (mw *mmapWriter) Flush() error {
+	if err := unix.Msync(mw.data, unix.MS_SYNC); err != nil {
+		return fmt.Errorf("failed to sync output file: %w", err)
+	}
+	return nil
+}
+
+// Close flushes and unmaps the data, then truncates the file to the written size.
+// The file itself is not closed.
+func (mw *mmapWriter) Close() error {
+	if err := mw.Flush(); err != nil {
+		return err
+	}
+	if err := unix.Munmap(mw.data); err != nil {
+		return fmt.Errorf("failed to unmap output file: %w", err)
+	}
+	mw.data = nil
+
+	if err := mw.file.Truncate(int64(mw.size)); err != nil {
+		return fmt.Errorf("failed to truncate output file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackFrame encodes a record as a MessagePack map, prefixed with its
+// length as a 4-byte big-endian integer so the records can be read back one
+// by one. The keys of the maps are sorted if sortKeys is set, else written in
+// no particular order. The frame is returned as a string to go through
+// writeLines.
+func msgpackFrame(record map[string]any, sortKeys bool) (string, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetSortMapKeys(sortKeys)
+	if err := enc.Encode(record); err != nil {
+		return "", fmt.Errorf("failed to encode record to MessagePack: %w", err)
+	}
+	data := buf.Bytes()
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	return string(append(frame, data...)), nil
+}
+
+// decode prints the records of a msgpack or timeseries output file as JSON,
+// one per line. The file may be gzip-compressed.
+func decode(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mqtt-trace decode <file>")
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", args[0], err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", args[0], err)
+		}
+		reader = bufio.NewReader(gz)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	if isTimeseries(reader) {
+		return decodeTimeseries(args[0], reader, out)
+	}
+	return decodeMsgpack(args[0], reader, out)
+}
+
+// decodeMsgpack prints the records of a msgpack output file as JSON
+func decodeMsgpack(path string, in io.Reader, out io.Writer) error {
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(in, header); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return truncatedRecord(path, err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(in, data); err != nil {
+			return truncatedRecord(path, err)
+		}
+
+		var record map[string]any
+		if err := msgpack.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("failed to decode record of %s: %w", path, err)
+		}
+		line, err := encodeRecords(record, "", false)
+		if err != nil {
+			return fmt.Errorf("failed to encode record to JSON: %w", err)
+		}
+		out.Write(line)
+	}
+}
+
+// recoverMsgpack truncates a msgpack output file after its last complete
+// frame, so that the records appended to it can be read back. A missing or
+// gzip-compressed file is left as is.
+func recoverMsgpack(path string) error {
+	header := make([]byte, 4)
+	return recoverRecords(path, func(r *bufio.Reader) (int64, int64, error) {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return 0, 0, err
+		}
+		return 4, int64(binary.BigEndian.Uint32(header)), nil
+	})
+}
+
+// recoverRecords truncates an output file after its last complete record,
+// next reading the header of a record and returning its size and the size
+// of the data following it
+func recoverRecords(path string, next func(r *bufio.Reader) (int64, int64, error)) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to check output file: %w", err)
+	}
+	reader := bufio.NewReader(file)
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return nil
+	}
+
+	// Records are only checked for length, a crash tears the last write
+	var complete int64
+	for {
+		header, size, err := next(reader)
+		if err != nil {
+			break
+		}
+		if complete+header+size > info.Size() {
+			break
+		}
+		if _, err := reader.Discard(int(size)); err != nil {
+			break
+		}
+		complete += header + size
+	}
+	if complete == info.Size() {
+		return nil
+	}
+
+	if err := file.Truncate(complete); err != nil {
+		return fmt.Errorf("failed to truncate the incomplete last record of %s: %w", path, err)
+	}
+	log.Printf("Truncated the incomplete last record of %s (%d bytes)", path, info.Size()-complete)
+	return nil
+}
+
+// truncatedRecord reports a last record cut short, as left by a crash, which
+// is not an error
+func truncatedRecord(path string, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Printf("Ignoring the truncated last record of %s", path)
+		return nil
+	}
+	return fmt.Errorf("failed to read %s: %w", path, err)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Policies applied when the output file already exists at startup
+const (
+	onExistingAppend    = "append"
+	onExistingTruncate  = "truncate"
+	onExistingFail      = "fail"
+	onExistingTimestamp = "timestamp"
+)
+
+// Ways of writing the output file
+const (
+	outputTypeFile = "file"
+	outputTypeMmap = "mmap"
+	outputTypeRing = "ring"
+)
+
+// Compressions of the output file
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+)
+
+// Formats of the output records
+const (
+	outputFormatLine    = "line"
+	outputFormatInflux  = "influx"
+	outputFormatGrouped = "grouped"
+	outputFormatMsgpack = "msgpack"
+	// outputFormatTimeseries writes the numeric output fields as compact
+	// delta-encoded series
+	outputFormatTimeseries = "timeseries"
+)
+
+// resolveOutputFile applies the on_existing policy to the output file and
+// returns the path messages should be written to
+func resolveOutputFile(path, policy string) (string, error) {
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check output file: %w", err)
+	}
+
+	switch policy {
+	case onExistingTruncate:
+		if err := os.Truncate(path, 0); err != nil {
+			return "", fmt.Errorf("failed to truncate output file: %w", err)
+		}
+	case onExistingFail:
+		return "", fmt.Errorf("output file %s already exists", path)
+	case onExistingTimestamp:
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), time.Now().Format("20060102-150405"), ext)
+	}
+
+	return path, nil
+}
+
+// openOutputFile opens a file in append mode, creating it if it doesn't exist
+func openOutputFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output file: %w", err)
+	}
+	return file, nil
+}
+
+// writeFileAtomic replaces the content of a file atomically: data is written
+// to a temporary file renamed over the previous one, so readers and crashes
+// never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// The data is synced before the rename, or a crash could leave the
+	// renamed file empty
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// resolveDailyFile applies the on_existing policy to the daily output file of
+// day, the first one written, as resolveOutputFile does to the output file:
+// it is truncated, refused, or the output file timestamped, so that all the
+// daily files of the run share the timestamp. The files of the next days
+// can't exist yet.
+func resolveDailyFile(path, policy, day string) (string, error) {
+	dated := dailyPath(path, day)
+	resolved, err := resolveOutputFile(dated, policy)
+	if err != nil || resolved == dated {
+		return path, err
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), time.Now().Format("20060102-150405"), ext), nil
+}
+
+// dailyPath returns the path of the output file for a day, e.g. mqtt-trace-2024-01-15.log
+func dailyPath(path, day string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), day, ext)
+}
+
+// switchDay moves to the next day's file when the date changed (in the
+// configured timezone) since the current file was opened. The previous file
+// is flushed and closed first. The caller must hold fw.mu.
+func (fw *FileWriter) switchDay() error {
+	day := fw.now().Format(time.DateOnly)
+	if day == fw.day {
+		return nil
+	}
+
+	file, err := openOutputFile(dailyPath(fw.filePath, day))
+	if err != nil {
+		return err
+	}
+
+	if fw.buf != nil {
+		if err := fw.buf.Flush(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to flush output file: %w", err)
+		}
+	}
+	var out io.Writer = file
+	if fw.gzip != nil {
+		if err := fw.gzip.Close(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to close gzip stream: %w", err)
+		}
+		fw.gzip.Reset(file)
+		out = fw.gzip
+	}
+	if fw.buf != nil {
+		fw.buf.Reset(out)
+	}
+	if err := fw.file.Close(); err != nil {
+		log.Printf("Error closing output file: %v", err)
+	}
+	if fw.index != nil {
+		if err := fw.index.save(); err != nil {
+			log.Printf("Error saving index file: %v", err)
+		}
+	}
+	if fw.archiveDaily {
+		// Compressing a whole day takes a while, don't hold the writer meanwhile
+		path, dir := fw.file.Name(), dailyArchiveDir(fw.filePath, fw.day)
+		archive := func(day string) {
+			if err := archiveDailyFile(path, dir, day, fw.format); err != nil {
+				log.Printf("Error archiving %s: %v", path, err)
+				return
+			}
+			log.Printf("Archived %s to %s", path, dir)
+		}
+		// Once Close waits for the archives, the last one is made in place
+		if fw.closing {
+			archive(fw.day)
+		} else {
+			fw.wg.Add(1)
+			go func(day string) {
+				defer fw.wg.Done()
+				archive(day)
+			}(fw.day)
+		}
+	}
+
+	fw.file = file
+	fw.day = day
+	fw.files = append(fw.files, file.Name())
+	log.Printf("Switched to output file %s", file.Name())
+
+	return nil
+}
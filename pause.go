@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+)
+
+// startPauseToggle pauses or resumes recording each time the process
+// receives SIGUSR2. While paused, messages are still received and counted,
+// as dropped, but nothing is written to the output file. The returned
+// function stops it.
+func startPauseToggle(writer *FileWriter) func() {
+	signals := make(chan os.Signal, 1)
+	if !notifyPause(signals) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				togglePause(writer)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// togglePause pauses recording, once the pending data is flushed so the
+// output file is complete, or resumes it
+func togglePause(writer *FileWriter) {
+	if writer.Paused() {
+		writer.SetPaused(false)
+		recordingPaused.Set(0)
+		log.Printf("Recording resumed")
+		return
+	}
+	writer.SetPaused(true)
+	recordingPaused.Set(1)
+	if err := writer.Flush(); err != nil {
+		log.Printf("Error flushing output file: %v", err)
+	}
+	log.Printf("Recording paused, send SIGUSR2 again to resume")
+}
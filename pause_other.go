@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyPause does nothing, there is no SIGUSR2 on this platform
+func notifyPause(c chan<- os.Signal) bool {
+	return false
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyPause relays SIGUSR2, the pause toggle signal, to c
+func notifyPause(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR2)
+	return true
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+)
+
+// handlePprof registers the runtime profiles on mux, under /debug/pprof/
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// startPprofServer serves the runtime profiles on addr. The returned function stops it.
+func startPprofServer(addr string) func() {
+	mux := http.NewServeMux()
+	handlePprof(mux)
+	log.Printf("Serving profiles on %s/debug/pprof/", addr)
+	return serveHTTP(addr, mux, "profiles")
+}
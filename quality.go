@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// Points taken off the connection quality score, out of 100
+const (
+	qualityLossPenalty   = 20 // per connection loss
+	qualityMaxLossPoints = 40
+	qualityGapPoints     = 30 // all the interval spent in gaps
+	qualityJitterPoints  = 30 // a mean coefficient of variation of 1 or more
+)
+
+// QualityScore rates the broker path from 0 to 100 over each interval, from
+// the connection losses, the gaps without any message and the jitter of the
+// topics. The score is 100 minus:
+//   - 20 points per connection loss, up to 40
+//   - 30 points times the fraction of the interval spent in gaps longer than gap
+//   - 30 points times the mean coefficient of variation (stddev / mean) of
+//     the intervals between messages of each topic, capped at 1
+type QualityScore struct {
+	mu     sync.Mutex
+	gap    time.Duration
+	start  time.Time // start of the current interval
+	last   time.Time // last message, of any topic
+	losses int
+	gaps   time.Duration
+	topics map[string]*arrivalStats
+	lru    *topicLRU
+}
+
+// NewQualityScore creates a quality score counting silences longer than gap
+// as gaps, tracking the jitter of up to maxTopics topics or any number if
+// maxTopics is 0
+func NewQualityScore(gap time.Duration, maxTopics int) *QualityScore {
+	now := time.Now()
+	return &QualityScore{
+		gap:    gap,
+		start:  now,
+		last:   now,
+		topics: make(map[string]*arrivalStats),
+		lru:    newTopicLRU("quality_score", maxTopics),
+	}
+}
+
+// Observe accounts for a message received on topic at t
+func (q *QualityScore) Observe(topic string, t time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.addGap(t)
+	q.last = t
+
+	if q.lru != nil {
+		if evicted, ok := q.lru.touch(topic); ok {
+			delete(q.topics, evicted)
+		}
+	}
+	stats, ok := q.topics[topic]
+	if !ok {
+		q.topics[topic] = &arrivalStats{last: t}
+		return
+	}
+	interval := t.Sub(stats.last).Seconds()
+	stats.last = t
+	stats.count++
+	delta := interval - stats.mean
+	stats.mean += delta / float64(stats.count)
+	stats.m2 += delta * (interval - stats.mean)
+}
+
+// ConnectionLost accounts for a lost connection to the broker
+func (q *QualityScore) ConnectionLost() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.losses++
+}
+
+// addGap accounts for the silence from the last message to t, within the
+// current interval, if longer than gap. The caller must hold q.mu.
+func (q *QualityScore) addGap(t time.Time) {
+	if t.Sub(q.last) <= q.gap {
+		return
+	}
+	from := q.last
+	if from.Before(q.start) {
+		from = q.start
+	}
+	q.gaps += t.Sub(from)
+}
+
+// Report computes the score of the interval ending now, exports it and logs
+// it, and writes it as a quality event if record is set. The next interval
+// starts afresh, the topics keeping their last message time.
+func (q *QualityScore) Report(writer *FileWriter, record bool) {
+	now := time.Now()
+
+	q.mu.Lock()
+	// Gaps are clamped to the interval, an ongoing one goes on in the next
+	q.addGap(now)
+	elapsed := now.Sub(q.start)
+	gaps := q.gaps
+	losses := q.losses
+
+	var cvSum float64
+	var cvTopics int
+	for _, stats := range q.topics {
+		if stats.count >= 2 && stats.mean > 0 {
+			cvSum += stats.stddev() / stats.mean
+			cvTopics++
+		}
+		*stats = arrivalStats{last: stats.last}
+	}
+	q.start = now
+	q.losses = 0
+	q.gaps = 0
+	q.mu.Unlock()
+
+	jitter := 0.0
+	if cvTopics > 0 {
+		jitter = cvSum / float64(cvTopics)
+	}
+	gapRatio := 0.0
+	if elapsed > 0 {
+		gapRatio = math.Min(gaps.Seconds()/elapsed.Seconds(), 1)
+	}
+	score := 100 -
+		math.Min(float64(losses*qualityLossPenalty), qualityMaxLossPoints) -
+		qualityGapPoints*gapRatio -
+		qualityJitterPoints*math.Min(jitter, 1)
+	score = math.Round(math.Max(score, 0))
+
+	qualityScore.Set(score)
+	log.Printf("Connection quality: %.0f (connection losses=%d gaps=%s jitter=%.2f)", score, losses, gaps.Round(time.Second), jitter)
+
+	if record {
+		fields := map[string]string{
+			"score":  fmt.Sprintf("%.0f", score),
+			"losses": fmt.Sprint(losses),
+			"gaps":   fmt.Sprintf("%.3f", gaps.Seconds()),
+			"jitter": fmt.Sprintf("%.3f", jitter),
+		}
+		if err := writer.WriteEvent("quality", fields); err != nil {
+			log.Printf("Error saving connection quality: %v", err)
+		}
+	}
+}
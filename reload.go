@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// Filters are the settings selecting and reshaping what is recorded of the
+// messages, which can be reloaded while running
+type Filters struct {
+	OutputFields    []string
+	RenameFields    []FieldRename
+	RenameCollision string
+	// NormalizeKeys is the case payload keys are normalized to, before or
+	// after renaming with NormalizeOrder, disabled when empty
+	NormalizeKeys  string
+	NormalizeOrder string
+	FieldTypes     map[string]string
+	// FieldMatch are the patterns payload fields must match for messages to
+	// be recorded
+	FieldMatch []fieldPattern
+	// Transform is nil without a transform expression
+	Transform *vm.Program
+}
+
+// newFilters gets the filters of a validated configuration, compiling the
+// field_match patterns and the transform expression if any
+func newFilters(config *Config) (*Filters, error) {
+	filters := &Filters{
+		OutputFields:    config.OutputFields,
+		RenameFields:    config.RenameFields,
+		RenameCollision: config.RenameCollision,
+		NormalizeKeys:   config.NormalizeKeys,
+		NormalizeOrder:  config.NormalizeOrder,
+		FieldTypes:      config.FieldTypes,
+	}
+	if len(config.FieldMatch) > 0 {
+		patterns, err := compileFieldMatch(config.FieldMatch)
+		if err != nil {
+			return nil, err
+		}
+		filters.FieldMatch = patterns
+	}
+	if config.Transform != "" {
+		program, err := expr.Compile(config.Transform, expr.Env(transformEnv{}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile transform: %w", err)
+		}
+		filters.Transform = program
+	}
+	return filters, nil
+}
+
+// startFilterReload reloads the filters from the configuration file each
+// time the process receives SIGUSR1, leaving the connection and all the other
+// settings as they are. The returned function stops it.
+func startFilterReload(handler *Handler, configPath string) func() {
+	signals := make(chan os.Signal, 1)
+	if !notifyReload(signals) {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				reloadFilters(handler, configPath)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// reloadFilters applies the filters of the configuration file to the next
+// messages. The whole file is validated, and nothing changes if it is invalid.
+func reloadFilters(handler *Handler, configPath string) {
+	config, err := loadConfig(configPath)
+	if err == nil {
+		var filters *Filters
+		if filters, err = newFilters(config); err == nil {
+			handler.SetFilters(filters)
+			log.Printf("Reloaded filters from %s: output_fields=%s rename_fields=%d transform=%t", configPath, strings.Join(filters.OutputFields, ","), len(filters.RenameFields), filters.Transform != nil)
+			return
+		}
+	}
+	log.Printf("Error reloading filters, keeping the current ones: %v", err)
+}
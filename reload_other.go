@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyReload does nothing, there is no SIGUSR1 on this platform
+func notifyReload(c chan<- os.Signal) bool {
+	return false
+}
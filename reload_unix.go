@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload relays SIGUSR1, the filter reload signal, to c
+func notifyReload(c chan<- os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
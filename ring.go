@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// ringHeaderSize is the size of the header at the start of a ring file
+const ringHeaderSize = 128
+
+// ringMagic starts the header of ring files
+const ringMagic = "mqtt-trace-ring v1"
+
+// ringWriter writes lines to a fixed-size file used as a circular buffer:
+// once the end is reached, writing wraps around and overwrites the oldest
+// lines. The header records where the next line goes, so the file can be
+// read back in order, and resumed.
+type ringWriter struct {
+	file    *os.File
+	size    int // size of the data area, after the header
+	head    int // offset in the data area the next line is written at
+	wrapped bool
+}
+
+// newRingWriter opens the ring of file, of size bytes of data. An empty file
+// is initialized, an existing ring is resumed at its head.
+func newRingWriter(file *os.File, size int) (*ringWriter, error) {
+	rw := &ringWriter{file: file, size: size}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ring file: %w", err)
+	}
+	if info.Size() == 0 {
+		if err := file.Truncate(int64(ringHeaderSize + size)); err != nil {
+			return nil, fmt.Errorf("failed to allocate ring file: %w", err)
+		}
+		return rw, rw.writeHeader()
+	}
+
+	header := make([]byte, ringHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read ring file header: %w", err)
+	}
+	var existing int
+	if _, err := fmt.Sscanf(string(header), ringMagic+" size=%d head=%d wrapped=%t", &existing, &rw.head, &rw.wrapped); err != nil {
+		return nil, fmt.Errorf("output file %s is not a ring file", file.Name())
+	}
+	if existing != size {
+		return nil, fmt.Errorf("ring file %s was created with ring_size %d, not %d", file.Name(), existing, size)
+	}
+	if rw.head < 0 || rw.head > size {
+		return nil, fmt.Errorf("ring file %s has an invalid head %d", file.Name(), rw.head)
+	}
+	return rw, nil
+}
+
+// Write writes one line, which must not be split across calls. A line that
+// doesn't fit before the end of the file goes to the start, the space left
+// at the end being filled with newlines.
+func (rw *ringWriter) Write(p []byte) (int, error) {
+	if len(p) > rw.size {
+		return 0, fmt.Errorf("line of %d bytes is larger than ring_size", len(p))
+	}
+
+	if rw.head+len(p) > rw.size {
+		fill := bytes.Repeat([]byte{'\n'}, rw.size-rw.head)
+		if _, err := rw.file.WriteAt(fill, int64(ringHeaderSize+rw.head)); err != nil {
+			return 0, fmt.Errorf("failed to write ring file: %w", err)
+		}
+		rw.head = 0
+		rw.wrapped = true
+	}
+
+	// Once wrapped, a line overwrites older ones, and the last of them is
+	// only partly overwritten unless the line ends where it ended
+	end := rw.head + len(p)
+	broken := false
+	if rw.wrapped && end < rw.size {
+		last := make([]byte, 1)
+		if _, err := rw.file.ReadAt(last, int64(ringHeaderSize+end-1)); err != nil {
+			return 0, fmt.Errorf("failed to read ring file: %w", err)
+		}
+		broken = last[0] != '\n'
+	}
+
+	if _, err := rw.file.WriteAt(p, int64(ringHeaderSize+rw.head)); err != nil {
+		return 0, fmt.Errorf("failed to write ring file: %w", err)
+	}
+	rw.head = end
+
+	if broken {
+		if err := rw.blankLine(end); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := rw.writeHeader(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// blankLine replaces the bytes from offset to the end of the line they are
+// part of with newlines, so a partly overwritten line reads as empty lines
+func (rw *ringWriter) blankLine(offset int) error {
+	buf := make([]byte, 4096)
+	for offset < rw.size {
+		n := min(len(buf), rw.size-offset)
+		if _, err := rw.file.ReadAt(buf[:n], int64(ringHeaderSize+offset)); err != nil {
+			return fmt.Errorf("failed to read ring file: %w", err)
+		}
+		i := bytes.IndexByte(buf[:n], '\n')
+		if i < 0 {
+			i = n
+		}
+		if _, err := rw.file.WriteAt(bytes.Repeat([]byte{'\n'}, i), int64(ringHeaderSize+offset)); err != nil {
+			return fmt.Errorf("failed to write ring file: %w", err)
+		}
+		if i < n {
+			return nil
+		}
+		offset += n
+	}
+	return nil
+}
+
+// writeHeader writes the header: the magic, the data size, the head offset
+// and whether writing wrapped around, padded with spaces
+func (rw *ringWriter) writeHeader() error {
+	header := fmt.Sprintf("%s size=%d head=%d wrapped=%t", ringMagic, rw.size, rw.head, rw.wrapped)
+	header += string(bytes.Repeat([]byte{' '}, ringHeaderSize-1-len(header))) + "\n"
+	if _, err := rw.file.WriteAt([]byte(header), 0); err != nil {
+		return fmt.Errorf("failed to write ring file header: %w", err)
+	}
+	return nil
+}
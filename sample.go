@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+)
+
+// Sampler randomly keeps a fraction of the messages of the topics with a
+// sample_ratio. Random sampling stays unbiased under bursty traffic, unlike
+// recording every Nth message.
+type Sampler struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	topics []TopicConfig
+}
+
+// NewSampler creates a sampler for the topics, seeded with seed for
+// reproducible samples, or randomly if seed is 0
+func NewSampler(topics []TopicConfig, seed uint64) *Sampler {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	return &Sampler{
+		rng:    rand.New(rand.NewPCG(seed, seed)),
+		topics: topics,
+	}
+}
+
+// Keep reports whether a message received on topic is sampled. The ratio is
+// the one of the first topic filter matching it, messages of topics without
+// a ratio are always kept.
+func (s *Sampler) Keep(topic string) bool {
+	for _, t := range s.topics {
+		if !topicMatches(t.Topic, topic) {
+			continue
+		}
+		if t.SampleRatio == nil {
+			return true
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.rng.Float64() < *t.SampleRatio
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleWindow is a period of the week during which messages are
+// recorded: from Start to End, "HH:MM" times of the schedule timezone, on
+// each of Days. A window ending before it starts runs past midnight, into the
+// next day.
+type ScheduleWindow struct {
+	// Days are day names (mon or monday) or ranges of them (mon-fri),
+	// every day when empty
+	Days  []string `mapstructure:"days"`
+	Start string   `mapstructure:"start"`
+	End   string   `mapstructure:"end"`
+
+	// Parsed days, and start and end as times of day
+	days       [7]bool
+	start, end time.Duration
+}
+
+// parse validates the window and parses its days and times
+func (w *ScheduleWindow) parse() error {
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("start and end are the same")
+	}
+
+	if len(w.Days) == 0 {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	for _, days := range w.Days {
+		from, to, isRange := strings.Cut(days, "-")
+		first, err := parseWeekday(from)
+		if err != nil {
+			return err
+		}
+		last := first
+		if isRange {
+			if last, err = parseWeekday(to); err != nil {
+				return err
+			}
+		}
+		// Ranges can wrap around the end of the week, e.g. sat-mon
+		for day := first; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// contains reports whether a wall clock time is within the window
+func (w *ScheduleWindow) contains(t time.Time) bool {
+	hour, minute, second := t.Clock()
+	clock := time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second
+	day := t.Weekday()
+
+	if w.start < w.end {
+		return w.days[day] && clock >= w.start && clock < w.end
+	}
+	// Past midnight, the window belongs to the day before
+	return w.days[day] && clock >= w.start || w.days[(day+6)%7] && clock < w.end
+}
+
+// parseTimeOfDay parses a "HH:MM" time of day, "24:00" being the end of the day
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseWeekday parses a day name, in full or its first three letters
+func parseWeekday(s string) (time.Weekday, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+// Schedule tells whether messages are recorded at a given time: only within
+// one of its windows. Pauses and resumes are logged when the messages
+// received go from one side of the schedule to the other.
+type Schedule struct {
+	windows  []ScheduleWindow
+	location *time.Location
+
+	mu     sync.Mutex
+	known  bool
+	active bool
+}
+
+// NewSchedule creates a schedule of parsed windows, in location
+func NewSchedule(windows []ScheduleWindow, location *time.Location) *Schedule {
+	return &Schedule{
+		windows:  windows,
+		location: location,
+	}
+}
+
+// Active reports whether messages received at t are recorded
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location)
+	active := false
+	for i := range s.windows {
+		if s.windows[i].contains(t) {
+			active = true
+			break
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.known || active != s.active {
+		if active {
+			log.Printf("Recording: inside the schedule")
+		} else {
+			log.Printf("Not recording: outside the schedule")
+		}
+		s.known = true
+		s.active = active
+	}
+	return active
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// selftestMessages is the number of messages published by the self-test
+	selftestMessages = 5
+	// selftestTimeout bounds the wait for the messages to be recorded
+	selftestTimeout = 10 * time.Second
+)
+
+// selftest checks the whole pipeline end to end against the configured
+// broker: it traces a dedicated topic to a temporary file, publishes a few
+// messages to it and verifies they were all recorded as expected
+func selftest(configPath string) error {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "mqtt-trace-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create self-test directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	id, err := newUUID()
+	if err != nil {
+		return fmt.Errorf("failed to generate self-test topic: %w", err)
+	}
+	topic := "mqtt-trace/selftest/" + id
+	selftestConfig(config, topic, filepath.Join(dir, "selftest.log"))
+
+	stop := make(chan struct{})
+	ready := func(client mqtt.Client) {
+		defer close(stop)
+
+		for i := range selftestMessages {
+			payload := fmt.Sprintf(`{"name":"selftest","seq":%d}`, i)
+			token := client.Publish(topic, 1, false, payload)
+			token.Wait()
+			if err := token.Error(); err != nil {
+				log.Printf("Error publishing self-test message: %v", err)
+				return
+			}
+		}
+
+		deadline := time.Now().Add(selftestTimeout)
+		for time.Now().Before(deadline) {
+			lines, _ := readLines(config.OutputFile)
+			if len(lines) >= selftestMessages {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if err := trace(config, ready, stop); err != nil {
+		return err
+	}
+
+	lines, err := readLines(config.OutputFile)
+	if err != nil {
+		return err
+	}
+	if len(lines) != selftestMessages {
+		return fmt.Errorf("self-test failed: %d messages recorded, expected %d", len(lines), selftestMessages)
+	}
+
+	// Messages of a single publisher on a single topic are delivered in order
+	for i, line := range lines {
+		_, fields, _ := strings.Cut(line, "|")
+		if expected := fmt.Sprintf("name=selftest|seq=%d", i); fields != expected {
+			return fmt.Errorf("self-test failed: line %d is %q, expected fields %q", i+1, line, expected)
+		}
+	}
+
+	log.Printf("Self-test passed: %d messages recorded through %s:%d", len(lines), config.MQTT.Broker, config.MQTT.Port)
+	return nil
+}
+
+// selftestConfig restricts a configuration to the self-test: only the
+// connection settings are kept, records are written unbuffered in the line
+// format with only the fields the self-test checks
+func selftestConfig(config *Config, topic, outputFile string) {
+	config.MQTT.Topics = []TopicConfig{{Topic: topic}}
+	config.Discovery.Topic = ""
+
+	config.OutputFile = outputFile
+	config.OnExisting = onExistingAppend
+	config.OutputType = outputTypeFile
+	config.OutputCompression = compressionNone
+	config.OutputFormat = outputFormatLine
+	config.OutputFields = []string{"name", "seq"}
+	config.MissingField = missingFieldOmit
+	config.DailyFiles = false
+	config.IndexFile = false
+	config.BufferSize = 0
+	config.SortBatchBy = ""
+	config.Downsample.Interval = 0
+	config.Shards = 0
+	config.DroppedLog = ""
+	config.ErrorsFile = ""
+	config.Baseline.File = ""
+	config.ArchiveOnExit = false
+	config.MaxDuration = 0
+	config.Schedule.Windows = nil
+
+	config.Transform = ""
+	config.BinaryTopics = nil
+	config.MaxPayloadKeys = 0
+	config.MaxFieldLength = 0
+	config.MaxFieldLengths = nil
+	config.FloatPrecision = nil
+	config.RenameFields = nil
+	config.NormalizeKeys = ""
+	config.PromoteFields = nil
+	config.FieldTypes = nil
+	config.FieldMatch = nil
+	config.Checksum.Field = ""
+	config.ControlChars = controlCharsAllow
+	config.Thresholds = nil
+	config.ThresholdAlerts.Record = false
+	config.ThresholdAlerts.Topic = ""
+	config.OnShapeMismatch = shapeMismatchRecord
+	config.Timestamp.Truncate = 0
+	config.Timestamp.MaxClockSkew = 0
+	config.DistinctPayloads.Enabled = false
+	config.DedupField = ""
+	config.CatchUp.Enabled = false
+	config.SessionID = ""
+	config.BrokerLabel = ""
+	config.MonotonicField = ""
+	config.TimeFields = nil
+	config.IncludeTopicDepth = false
+	config.IncludePayloadType = false
+	config.IncludeShapeID = false
+	config.IncludeProcessingTime = false
+
+	config.StatusTopic = ""
+	config.SummaryFile = ""
+	config.StateFile = ""
+	config.AuditFile = ""
+	config.EventWebhook.URL = ""
+	config.GRPC.Endpoint = ""
+	config.Stream.Listen = ""
+	config.Heartbeat.Enabled = false
+	config.JitterStats.Enabled = false
+	config.QualityScore.Enabled = false
+	config.Metrics.Listen = ""
+	config.Pprof.Enabled = false
+	config.TLS.RecordDetails = false
+}
+
+// readLines returns the lines of a file
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+	return lines, nil
+}
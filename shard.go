@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shardKeyTopic is the shard_key value sharding the records by topic
+const shardKeyTopic = "topic"
+
+// outputShard is one of the output files records are sharded across
+type outputShard struct {
+	file *os.File
+	// buf buffers the writes to file, nil without buffer_size
+	buf *bufio.Writer
+}
+
+// writer returns where the lines of the shard are written
+func (s *outputShard) writer() io.Writer {
+	if s.buf != nil {
+		return s.buf
+	}
+	return s.file
+}
+
+// shardPath returns the path of a shard of the output file: the index is
+// inserted before the extension, mqtt-trace.log giving mqtt-trace-shard-0.log
+func shardPath(path string, shard int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-shard-%d%s", strings.TrimSuffix(path, ext), shard, ext)
+}
+
+// shardIndex returns the shard of a key among shards: the 32-bit FNV-1a hash
+// of the key modulo the number of shards, so a key always goes to the same
+// shard for a given number of shards, across restarts and machines
+func shardIndex(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// shardOf returns the shard a message of topic goes to, or -1 without
+// sharding. Sharded by a payload field, messages without it, or with a null
+// one, go by their topic.
+func (fw *FileWriter) shardOf(topic string, payload map[string]any) int {
+	if fw.shards == nil {
+		return -1
+	}
+	key := topic
+	if fw.shardKey != shardKeyTopic {
+		if value, ok := payloadField(payload, fw.shardKey); ok && value != nil {
+			if s, ok := value.(string); ok {
+				key = s
+			} else if data, err := json.Marshal(value); err == nil {
+				key = string(data)
+			}
+		}
+	}
+	return shardIndex(key, len(fw.shards))
+}
+
+// openShards opens the output shards after the first one, already opened as
+// the output file, with a write buffer of bufferSize bytes if positive, once
+// recovered with recoverFile
+func (fw *FileWriter) openShards(path string, shards, bufferSize int, recoverFile func(string) error) error {
+	for i := 1; i < shards; i++ {
+		shard := shardPath(path, i)
+		if err := recoverFile(shard); err != nil {
+			return err
+		}
+		file, err := openOutputFile(shard)
+		if err != nil {
+			return err
+		}
+		s := &outputShard{file: file}
+		if bufferSize > 0 {
+			s.buf = bufio.NewWriterSize(file, bufferSize)
+		}
+		fw.shards = append(fw.shards, s)
+		fw.files = append(fw.files, shard)
+	}
+	return nil
+}
+
+// closeShards closes the output shards after the first one
+func (fw *FileWriter) closeShards() {
+	for i, shard := range fw.shards {
+		if i == 0 {
+			continue
+		}
+		if err := shard.file.Close(); err != nil {
+			log.Printf("Error closing output shard %s: %v", shard.file.Name(), err)
+		}
+	}
+}
+
+// resolveShardFiles applies the on_existing policy to the shards of the
+// output file, as resolveOutputFile does to the output file: the shards are
+// truncated, refused, or the output file timestamped, if any of them exists
+func resolveShardFiles(path, policy string, shards int) (string, error) {
+	exists := false
+	for i := 0; i < shards; i++ {
+		if _, err := os.Stat(shardPath(path, i)); err == nil {
+			exists = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("failed to check output file: %w", err)
+		}
+	}
+	if !exists {
+		return path, nil
+	}
+
+	switch policy {
+	case onExistingTruncate, onExistingFail:
+		for i := 0; i < shards; i++ {
+			if _, err := resolveOutputFile(shardPath(path, i), policy); err != nil {
+				return "", err
+			}
+		}
+	case onExistingTimestamp:
+		ext := filepath.Ext(path)
+		path = fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), time.Now().Format("20060102-150405"), ext)
+	}
+	return path, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// bufferedMessage is a message received before the subscriptions completed
+type bufferedMessage struct {
+	client mqtt.Client
+	msg    mqtt.Message
+}
+
+// StartupBuffer holds the messages received while the initial subscriptions
+// are in progress, e.g. those a persistent session delivers right after
+// connecting, and hands them to the message handler in order once all of
+// them are confirmed
+type StartupBuffer struct {
+	mu       sync.Mutex
+	handler  mqtt.MessageHandler
+	drops    *DropLog
+	max      int
+	queue    []bufferedMessage
+	released bool
+}
+
+// NewStartupBuffer creates a buffer of up to max messages for handler
+func NewStartupBuffer(handler mqtt.MessageHandler, drops *DropLog, max int) *StartupBuffer {
+	return &StartupBuffer{
+		handler: handler,
+		drops:   drops,
+		max:     max,
+	}
+}
+
+// HandleMessage buffers the message until Release, and passes it to the
+// handler afterwards
+func (b *StartupBuffer) HandleMessage(client mqtt.Client, msg mqtt.Message) {
+	if b.hold(client, msg) {
+		return
+	}
+	b.handler(client, msg)
+}
+
+// HandleEarly only buffers the message until Release, and ignores it
+// afterwards, like paho does for messages without a handler. Ignored
+// messages are acknowledged, else with manual_ack they would be redelivered.
+func (b *StartupBuffer) HandleEarly(client mqtt.Client, msg mqtt.Message) {
+	if !b.hold(client, msg) {
+		msg.Ack()
+	}
+}
+
+// hold buffers the message if not released yet, reporting whether it did.
+// The messages past max are dropped.
+func (b *StartupBuffer) hold(client mqtt.Client, msg mqtt.Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.released {
+		return false
+	}
+	if len(b.queue) >= b.max {
+		log.Printf("Dropping message on topic %s: startup buffer full", msg.Topic())
+		b.drops.Drop(msg.Topic(), dropStartupOverflow)
+		msg.Ack()
+		return true
+	}
+	b.queue = append(b.queue, bufferedMessage{client: client, msg: msg})
+	return true
+}
+
+// Release hands the buffered messages to the handler, then lets the next
+// ones through. Messages received meanwhile wait for the buffered ones to
+// be handled, so the order is kept.
+func (b *StartupBuffer) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, m := range b.queue {
+		b.handler(m.client, m.msg)
+	}
+	log.Printf("Processed %d messages buffered until the subscriptions completed", len(b.queue))
+	b.queue = nil
+	b.released = true
+}
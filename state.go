@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+)
+
+// setState records the latest record of a topic for the state file
+func (fw *FileWriter) setState(topic string, record map[string]any) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if fw.stateTopics != nil {
+		if evicted, ok := fw.stateTopics.touch(topic); ok {
+			delete(fw.state, evicted)
+		}
+	}
+	fw.state[topic] = record
+	fw.stateDirty = true
+}
+
+// WriteState writes the latest record of each topic to the state file, if
+// any was recorded since it was last written
+func (fw *FileWriter) WriteState() error {
+	fw.mu.Lock()
+	if !fw.stateDirty {
+		fw.mu.Unlock()
+		return nil
+	}
+	data, err := fw.encodeJSON(fw.state, "  ")
+	fw.stateDirty = false
+	fw.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	if err := writeFileAtomic(fw.statePath, data); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// status is the payload published to the status topic
+type status struct {
+	Messages      uint64  `json:"messages"`
+	Dropped       uint64  `json:"dropped"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Connected     bool    `json:"connected"`
+}
+
+// startStatusPublisher publishes the capture status as a retained message
+// every interval, so late subscribers always see the latest one. The returned
+// function stops it.
+func startStatusPublisher(client mqtt.Client, writer *FileWriter, drops *DropLog, topic string, qos byte, interval time.Duration) func() {
+	return runEvery(interval, func() {
+		if !client.IsConnectionOpen() {
+			return
+		}
+
+		payload, err := json.Marshal(status{
+			Messages:      writer.Recorded(),
+			Dropped:       drops.Total(),
+			UptimeSeconds: time.Since(startTime).Round(time.Second).Seconds(),
+			Connected:     true,
+		})
+		if err != nil {
+			log.Printf("Error encoding status: %v", err)
+			return
+		}
+
+		token := client.Publish(topic, qos, true, payload)
+		if token.WaitTimeout(interval) && token.Error() != nil {
+			log.Printf("Error publishing status to %s: %v", topic, token.Error())
+		}
+	})
+}
+
+// publishBirth publishes the birth message, signaling the tracer is online.
+// It is called on every connection, reconnections included.
+func publishBirth(client mqtt.Client, topic, payload string, qos byte, retained bool) {
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		log.Printf("Error publishing birth message to %s: timed out", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		log.Printf("Error publishing birth message to %s: %v", topic, err)
+		return
+	}
+	log.Printf("Published birth message to %s", topic)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies for the stream clients not keeping up with the records
+const (
+	// slowClientDrop drops the records the client has no room for
+	slowClientDrop = "drop"
+	// slowClientDisconnect disconnects the client
+	slowClientDisconnect = "disconnect"
+)
+
+// streamKeepAlive is how often an idle stream is sent a comment, so that
+// proxies keep the connection open
+const streamKeepAlive = 30 * time.Second
+
+// StreamHub fans the live records out to the clients of the /stream endpoint,
+// each with its own bounded buffer: records are never waited for, a client
+// without room for one misses it, or is disconnected, as set by onSlowClient
+type StreamHub struct {
+	mu           sync.Mutex
+	clients      map[*streamClient]struct{}
+	closed       bool
+	buffer       int
+	onSlowClient string
+}
+
+// streamClient is a client of the /stream endpoint
+type streamClient struct {
+	records chan []byte
+	// dropped counts the records missed since the client was last sent one
+	dropped atomic.Uint64
+	// gone is closed when the client is disconnected by the hub
+	gone chan struct{}
+}
+
+// NewStreamHub creates a hub buffering up to buffer records per client
+func NewStreamHub(buffer int, onSlowClient string) *StreamHub {
+	return &StreamHub{
+		clients:      make(map[*streamClient]struct{}),
+		buffer:       buffer,
+		onSlowClient: onSlowClient,
+	}
+}
+
+// Publish sends a record to every client that has room for it
+func (h *StreamHub) Publish(record []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		select {
+		case client.records <- record:
+			continue
+		default:
+		}
+		streamDropped.Inc()
+		if h.onSlowClient == slowClientDisconnect {
+			h.remove(client)
+			continue
+		}
+		client.dropped.Add(1)
+	}
+}
+
+// subscribe adds a client, or returns nil once the hub is closed
+func (h *StreamHub) subscribe() *streamClient {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	client := &streamClient{records: make(chan []byte, h.buffer), gone: make(chan struct{})}
+	h.clients[client] = struct{}{}
+	streamClients.Set(float64(len(h.clients)))
+	return client
+}
+
+// unsubscribe removes a client that went away
+func (h *StreamHub) unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[client]; ok {
+		h.remove(client)
+	}
+}
+
+// remove disconnects a client. The caller must hold h.mu.
+func (h *StreamHub) remove(client *streamClient) {
+	delete(h.clients, client)
+	close(client.gone)
+	streamClients.Set(float64(len(h.clients)))
+}
+
+// Close disconnects all the clients, so that the endpoint can be stopped
+func (h *StreamHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for client := range h.clients {
+		h.remove(client)
+	}
+}
+
+// ServeHTTP streams the records as server-sent events, one JSON record per
+// message event, each preceded by a dropped event with the number of records
+// missed if any
+func (h *StreamHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	client := h.subscribe()
+	if client == nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var event []byte
+		select {
+		case record := <-client.records:
+			if dropped := client.dropped.Swap(0); dropped > 0 {
+				event = fmt.Appendf(event, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			event = append(event, "data: "...)
+			event = append(event, bytes.TrimSuffix(record, []byte("\n"))...)
+			event = append(event, "\n\n"...)
+		case <-keepAlive.C:
+			event = []byte(": keep-alive\n\n")
+		case <-client.gone:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if _, err := w.Write(event); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// startStreamServer serves the live records of hub on addr, under /stream.
+// The returned function disconnects the clients and stops it.
+func startStreamServer(addr string, hub *StreamHub) func() {
+	mux := http.NewServeMux()
+	mux.Handle("/stream", hub)
+	log.Printf("Streaming records on %s/stream", addr)
+	stop := serveHTTP(addr, mux, "stream")
+	return func() {
+		hub.Close()
+		stop()
+	}
+}
+
+// publishMessage sends the JSON record of a message to the stream clients
+func (fw *FileWriter) publishMessage(t time.Time, topic string, fields []field) {
+	record := fw.messageRecord(t, topic, fields)
+	if fw.envelope == nil {
+		record["topic"] = topic
+	}
+	data, err := encodeRecords(record, "", fw.escapeHTML)
+	if err != nil {
+		log.Printf("Error encoding record of %s for the stream: %v", topic, err)
+		return
+	}
+	fw.stream.Publish(data)
+}
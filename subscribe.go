@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// subackFailure is the SUBACK return code for a rejected subscription
+const subackFailure = 0x80
+
+// Values of mqtt.resubscribe_qos
+const (
+	resubscribeGranted   = "granted"
+	resubscribeRequested = "requested"
+)
+
+// Subscriptions keeps track of the subscribed topic filters so they can be
+// restored when the client reconnects with a clean session
+type Subscriptions struct {
+	mu         sync.Mutex
+	requested  map[string]byte
+	granted    map[string]byte
+	priorities map[string]int
+	handler    mqtt.MessageHandler
+	useGranted bool
+	active     int // number of subscriptions accounted for in the gauge
+	audit      *AuditLog
+}
+
+// NewSubscriptions creates the subscriptions for the requested filters,
+// subscribed by decreasing priority, 0 for the filters without one. If
+// useGranted is set, reconnects subscribe with the QoS granted by the first
+// SUBACK instead of the requested one. The subscriptions are recorded to
+// audit, which may be nil.
+func NewSubscriptions(requested map[string]byte, priorities map[string]int, handler mqtt.MessageHandler, useGranted bool, audit *AuditLog) *Subscriptions {
+	return &Subscriptions{
+		requested:  requested,
+		priorities: priorities,
+		handler:    handler,
+		useGranted: useGranted,
+		audit:      audit,
+	}
+}
+
+// Subscribe performs the initial subscription and records the granted QoS
+func (s *Subscriptions) Subscribe(client mqtt.Client) error {
+	if levels := priorityLevels(s.requested, s.priorities); len(levels) > 1 {
+		order := make([]string, len(levels))
+		for i, level := range levels {
+			order[i] = fmt.Sprintf("%d: %s", level.priority, strings.Join(slices.Sorted(maps.Keys(level.filters)), ", "))
+		}
+		log.Printf("Subscribing by priority: %s", strings.Join(order, "; "))
+	}
+
+	granted, err := subscribeAll(client, s.requested, s.priorities, s.handler)
+	s.setActive(len(granted))
+	s.auditSubscribe(granted, err)
+	if err != nil {
+		return err
+	}
+
+	for topic, qos := range granted {
+		if qos != s.requested[topic] {
+			log.Printf("Broker granted qos %d instead of %d for topic %s", qos, s.requested[topic], topic)
+		}
+	}
+
+	s.mu.Lock()
+	s.granted = granted
+	s.mu.Unlock()
+
+	return nil
+}
+
+// OnConnect restores the subscriptions after a reconnect. It is a no-op
+// until the initial subscription is done.
+func (s *Subscriptions) OnConnect(client mqtt.Client) {
+	s.mu.Lock()
+	if s.granted == nil {
+		s.mu.Unlock()
+		return
+	}
+	// Topics can be added or removed while resubscribing, work on copies
+	original := maps.Clone(s.granted)
+	filters := maps.Clone(s.requested)
+	s.mu.Unlock()
+
+	if s.useGranted {
+		filters = original
+	}
+
+	granted, err := subscribeAll(client, filters, s.priorities, s.handler)
+	s.setActive(len(granted))
+	s.auditSubscribe(granted, err)
+	if err != nil {
+		log.Printf("Error resubscribing after reconnect: %v", err)
+		return
+	}
+
+	for topic, qos := range granted {
+		if qos != original[topic] {
+			log.Printf("Broker granted qos %d for topic %s after reconnect, originally %d", qos, topic, original[topic])
+		}
+	}
+	log.Printf("Resubscribed to %d topics after reconnect", len(granted))
+}
+
+// OnConnectionLost accounts for the subscriptions lost with the connection
+func (s *Subscriptions) OnConnectionLost(client mqtt.Client, err error) {
+	log.Printf("Connection to MQTT broker lost: %v", err)
+	s.setActive(0)
+}
+
+// Add subscribes to one more topic filter, restored after reconnects like the
+// initial ones. It is a no-op if the filter is already subscribed.
+func (s *Subscriptions) Add(client mqtt.Client, topic string, qos byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.requested[topic]; ok {
+		return nil
+	}
+
+	granted, err := subscribeBatch(client, map[string]byte{topic: qos}, s.handler)
+	s.auditSubscribe(granted, err)
+	if err != nil {
+		return err
+	}
+
+	s.requested[topic] = qos
+	s.granted[topic] = granted[topic]
+	s.active++
+	subscriptionsActive.Inc()
+	return nil
+}
+
+// Remove unsubscribes from a topic filter added with Add
+func (s *Subscriptions) Remove(client mqtt.Client, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.requested[topic]; !ok {
+		return nil
+	}
+
+	token := client.Unsubscribe(topic)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to unsubscribe from topic %s: %w", topic, err)
+	}
+	log.Printf("Unsubscribed from topic: %s", topic)
+	s.audit.Record("unsubscribe", map[string]string{"topic": topic})
+
+	delete(s.requested, topic)
+	delete(s.granted, topic)
+	s.active--
+	subscriptionsActive.Dec()
+	return nil
+}
+
+// UnsubscribeAll unsubscribes from all the topic filters, waiting up to
+// timeout for the broker to acknowledge it. The filters are kept, the
+// subscriptions are not restored afterwards. Messages the broker sent before
+// the unsubscription still reach the handler.
+func (s *Subscriptions) UnsubscribeAll(client mqtt.Client, timeout time.Duration) error {
+	s.mu.Lock()
+	topics := slices.Sorted(maps.Keys(s.requested))
+	s.mu.Unlock()
+	if len(topics) == 0 {
+		return nil
+	}
+
+	// Paho removes the handlers as soon as the request is sent, put them
+	// back for the messages already on their way
+	token := client.Unsubscribe(topics...)
+	for _, topic := range topics {
+		client.AddRoute(topic, s.handler)
+	}
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out unsubscribing from %d topics", len(topics))
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("failed to unsubscribe: %w", err)
+	}
+	log.Printf("Unsubscribed from %d topics", len(topics))
+	for _, topic := range topics {
+		s.audit.Record("unsubscribe", map[string]string{"topic": topic})
+	}
+	s.setActive(0)
+	return nil
+}
+
+// auditSubscribe records the subscriptions granted, in topic order, and the
+// error of those that failed if any
+func (s *Subscriptions) auditSubscribe(granted map[string]byte, err error) {
+	for _, topic := range slices.Sorted(maps.Keys(granted)) {
+		s.audit.Record("subscribe", map[string]string{"topic": topic, "qos": fmt.Sprint(granted[topic])})
+	}
+	if err != nil {
+		s.audit.Record("subscribe_failed", map[string]string{"error": err.Error()})
+	}
+}
+
+// setActive updates the number of active subscriptions. The gauge is shared
+// between all the sets of subscriptions, so it is adjusted by the difference.
+func (s *Subscriptions) setActive(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriptionsActive.Add(float64(n - s.active))
+	s.active = n
+}
+
+// priorityLevel holds the topic filters of a subscription priority
+type priorityLevel struct {
+	priority int
+	filters  map[string]byte
+}
+
+// priorityLevels groups the topic filters by priority, the highest first
+func priorityLevels(filters map[string]byte, priorities map[string]int) []priorityLevel {
+	byPriority := make(map[int]map[string]byte)
+	for topic, qos := range filters {
+		priority := priorities[topic]
+		if byPriority[priority] == nil {
+			byPriority[priority] = make(map[string]byte)
+		}
+		byPriority[priority][topic] = qos
+	}
+
+	levels := make([]priorityLevel, 0, len(byPriority))
+	for _, priority := range slices.Sorted(maps.Keys(byPriority)) {
+		levels = append(levels, priorityLevel{priority: priority, filters: byPriority[priority]})
+	}
+	slices.Reverse(levels)
+	return levels
+}
+
+// subscribeAll subscribes to all topic filters by decreasing priority, each
+// priority with a single SUBSCRIBE request acknowledged before the next one,
+// and returns the QoS granted for each of them. On error, the QoS returned
+// are those of the topics subscribed so far.
+func subscribeAll(client mqtt.Client, filters map[string]byte, priorities map[string]int, handler mqtt.MessageHandler) (map[string]byte, error) {
+	levels := priorityLevels(filters, priorities)
+	if len(levels) <= 1 {
+		return subscribeBatch(client, filters, handler)
+	}
+
+	grantedQoS := make(map[string]byte, len(filters))
+	for _, level := range levels {
+		granted, err := subscribeBatch(client, level.filters, handler)
+		maps.Copy(grantedQoS, granted)
+		if err != nil {
+			return grantedQoS, err
+		}
+	}
+	return grantedQoS, nil
+}
+
+// subscribeBatch subscribes to topic filters in a single SUBSCRIBE request
+// and returns the QoS granted for each of them. Topics that fail are retried
+// one by one so that the error reported names the offending topic; the QoS
+// returned along with the error are those of the topics subscribed so far.
+func subscribeBatch(client mqtt.Client, filters map[string]byte, handler mqtt.MessageHandler) (map[string]byte, error) {
+	grantedQoS := make(map[string]byte, len(filters))
+	if len(filters) == 0 {
+		return grantedQoS, nil
+	}
+
+	topics := make([]string, 0, len(filters))
+	for topic := range filters {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+
+	var retry []string
+
+	token := client.SubscribeMultiple(filters, handler)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		log.Printf("Batch subscribe failed, subscribing individually: %v", err)
+		retry = topics
+	} else {
+		result := token.(*mqtt.SubscribeToken).Result()
+		for _, topic := range topics {
+			granted, ok := result[topic]
+			if !ok || granted == subackFailure {
+				retry = append(retry, topic)
+				continue
+			}
+			log.Printf("Subscribed to topic: %s (qos %d)", topic, granted)
+			grantedQoS[topic] = granted
+		}
+		if len(retry) > 0 {
+			log.Printf("Broker rejected %d of %d subscriptions, subscribing individually", len(retry), len(filters))
+		}
+	}
+
+	for _, topic := range retry {
+		token := client.Subscribe(topic, filters[topic], handler)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return grantedQoS, fmt.Errorf("failed to subscribe to topic %s: %w", topic, err)
+		}
+		granted, ok := token.(*mqtt.SubscribeToken).Result()[topic]
+		if !ok || granted == subackFailure {
+			return grantedQoS, fmt.Errorf("broker rejected subscription to topic %s", topic)
+		}
+		log.Printf("Subscribed to topic: %s (qos %d)", topic, granted)
+		grantedQoS[topic] = granted
+	}
+
+	return grantedQoS, nil
+}
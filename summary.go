@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubscriptionCounts counts the recorded messages matching each configured
+// subscription filter, telling which subscriptions deliver
+type SubscriptionCounts struct {
+	mu      sync.Mutex
+	filters []string
+	counts  map[string]uint64
+}
+
+// NewSubscriptionCounts creates the counts of the subscription filters, all
+// starting at 0
+func NewSubscriptionCounts(topics []TopicConfig) *SubscriptionCounts {
+	c := &SubscriptionCounts{counts: make(map[string]uint64, len(topics))}
+	for _, topic := range topics {
+		if _, ok := c.counts[topic.Topic]; !ok {
+			c.filters = append(c.filters, topic.Topic)
+			c.counts[topic.Topic] = 0
+		}
+	}
+	return c
+}
+
+// Observe accounts for a message recorded on topic, counted once for each
+// filter it matches
+func (c *SubscriptionCounts) Observe(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, filter := range c.filters {
+		if topicMatches(filter, topic) {
+			c.counts[filter]++
+		}
+	}
+}
+
+// Counts returns a copy of the counts by filter
+func (c *SubscriptionCounts) Counts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[string]uint64, len(c.counts))
+	for filter, count := range c.counts {
+		counts[filter] = count
+	}
+	return counts
+}
+
+// summary is the content of the summary file
+type summary struct {
+	Started       string            `json:"started"`
+	Written       string            `json:"written"`
+	Recorded      uint64            `json:"recorded"`
+	Dropped       uint64            `json:"dropped"`
+	Subscriptions map[string]uint64 `json:"subscriptions"`
+}
+
+// writeSummary writes the summary of the capture so far to path
+func writeSummary(path string, location *time.Location, writer *FileWriter, drops *DropLog, counts *SubscriptionCounts) error {
+	data, err := json.MarshalIndent(summary{
+		Started:       startTime.In(location).Format(time.RFC3339),
+		Written:       time.Now().In(location).Format(time.RFC3339),
+		Recorded:      writer.Recorded(),
+		Dropped:       drops.Total(),
+		Subscriptions: counts.Counts(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode summary: %w", err)
+	}
+	if err := writeFileAtomic(path, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write summary file: %w", err)
+	}
+	return nil
+}
+
+// logIdleSubscriptions logs the subscription filters that matched no
+// recorded message
+func logIdleSubscriptions(counts *SubscriptionCounts) {
+	var idle []string
+	for filter, count := range counts.Counts() {
+		if count == 0 {
+			idle = append(idle, filter)
+		}
+	}
+	if len(idle) > 0 {
+		slices.Sort(idle)
+		log.Printf("Subscriptions without any recorded message: %s", strings.Join(idle, ", "))
+	}
+}
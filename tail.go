@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tailPollInterval is how often tail checks the file for new records
+const tailPollInterval = 250 * time.Millisecond
+
+// tailRecord is a record read back from an output file
+type tailRecord struct {
+	time   time.Time
+	topic  string
+	fields []field
+}
+
+// tail follows an output file like tail -f, printing the records as they are
+// appended, optionally filtered by topic, time and fields
+func tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	topic := flags.String("topic", "", "only print the records of the topics matching this filter (wildcards allowed)")
+	since := flags.String("since", "", "also print the records already in the file since this time: a duration (e.g. 10m) or an RFC3339 date")
+	fieldList := flags.String("fields", "", "comma-separated fields to print, all by default")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: mqtt-trace tail [flags] <file>\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("tail takes exactly one file")
+	}
+
+	var from time.Time
+	if *since != "" {
+		if d, err := time.ParseDuration(*since); err == nil {
+			from = time.Now().Add(-d)
+		} else if from, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("--since must be a duration or an RFC3339 date, got %q", *since)
+		}
+	}
+	var fields []string
+	if *fieldList != "" {
+		fields = strings.Split(*fieldList, ",")
+	}
+
+	return followFile(flags.Arg(0), !from.IsZero(), func(line string) {
+		record, ok := parseRecord(line)
+		if !ok {
+			return
+		}
+		if !from.IsZero() && record.time.Before(from) {
+			return
+		}
+		if *topic != "" && (record.topic == "" || !topicMatches(*topic, record.topic)) {
+			return
+		}
+		fmt.Println(formatTailRecord(record, fields))
+	})
+}
+
+// followFile calls handle with each complete line appended to path, forever.
+// It starts at the end of the file, or at its start if fromStart is set. A
+// file truncated or replaced (e.g. by on_existing or log rotation) is read
+// again from its start.
+func followFile(path string, fromStart bool, handle func(string)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer func() {
+		file.Close()
+	}()
+
+	var offset int64
+	if !fromStart {
+		if offset, err = file.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		offset += int64(len(line))
+		if err == nil {
+			handle(strings.TrimSuffix(partial+line, "\n"))
+			partial = ""
+			continue
+		}
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		// Keep an incomplete last line until the rest of it is written
+		partial += line
+
+		time.Sleep(tailPollInterval)
+
+		current, err := os.Stat(path)
+		if err != nil {
+			// The file may be being replaced, try again later
+			continue
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if os.SameFile(current, opened) && current.Size() >= offset {
+			continue
+		}
+
+		if os.SameFile(current, opened) {
+			_, err = file.Seek(0, io.SeekStart)
+		} else {
+			file.Close()
+			file, err = os.Open(path)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to reopen %s: %w", path, err)
+		}
+		reader.Reset(file)
+		offset = 0
+		partial = ""
+	}
+}
+
+// parseRecord parses a record of the line format, <date>|<key>=<value>...,
+// or of the influx format. Other lines, e.g. grouped JSON, are not records.
+func parseRecord(line string) (tailRecord, bool) {
+	date, rest, ok := strings.Cut(line, "|")
+	if t, err := time.Parse(time.RFC3339, date); err == nil {
+		record := tailRecord{time: t}
+		if !ok {
+			return record, true
+		}
+		for _, part := range strings.Split(rest, "|") {
+			key, value, _ := strings.Cut(part, "=")
+			if key == "topic" {
+				record.topic = value
+			}
+			record.fields = append(record.fields, field{key: key, value: value})
+		}
+		return record, true
+	}
+	return parseInfluxRecord(line)
+}
+
+// parseInfluxRecord parses an InfluxDB line protocol record, as written by
+// influxLine: its topic tag and fields, string values being unquoted
+func parseInfluxRecord(line string) (tailRecord, bool) {
+	parts := splitUnescaped(line, ' ', true)
+	if len(parts) != 3 {
+		return tailRecord{}, false
+	}
+	ns, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return tailRecord{}, false
+	}
+	record := tailRecord{time: time.Unix(0, ns)}
+
+	tags := splitUnescaped(parts[0], ',', false)
+	for _, tag := range tags[1:] {
+		kv := splitUnescaped(tag, '=', false)
+		if len(kv) == 2 && unescapeInflux(kv[0]) == "topic" {
+			record.topic = unescapeInflux(kv[1])
+		}
+	}
+
+	for _, f := range splitUnescaped(parts[1], ',', true) {
+		kv := splitUnescaped(f, '=', true)
+		if len(kv) != 2 {
+			return tailRecord{}, false
+		}
+		value := kv[1]
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		}
+		record.fields = append(record.fields, field{key: unescapeInflux(kv[0]), value: value})
+	}
+	return record, true
+}
+
+// splitUnescaped splits s on sep, except where sep is escaped with a
+// backslash or, if quotes is set, within a double-quoted string
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the backslashes escaping names, tags and field keys
+func unescapeInflux(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ").Replace(s)
+}
+
+// formatTailRecord formats a record for the terminal: its date, its topic if
+// known, then its fields, only the listed ones if any
+func formatTailRecord(record tailRecord, fields []string) string {
+	var b strings.Builder
+	b.WriteString(record.time.Format(time.RFC3339))
+	if record.topic != "" {
+		b.WriteString("  " + record.topic)
+	}
+	sep := "  "
+	for _, f := range record.fields {
+		if f.key == "topic" || len(fields) > 0 && !slices.Contains(fields, f.key) {
+			continue
+		}
+		fmt.Fprintf(&b, "%s%s=%v", sep, f.key, f.value)
+		sep = " "
+	}
+	return b.String()
+}
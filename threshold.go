@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// States of a threshold alert
+const (
+	thresholdAlert = "alert"
+	thresholdOK    = "ok"
+)
+
+// Threshold raises an alert when a numeric payload field goes below or
+// above a limit, and clears it once the field is back within the limit by
+// Hysteresis, so a value hovering around the limit doesn't flap
+type Threshold struct {
+	Field      string   `mapstructure:"field"`
+	Below      *float64 `mapstructure:"below"`
+	Above      *float64 `mapstructure:"above"`
+	Hysteresis float64  `mapstructure:"hysteresis"`
+}
+
+// crossed reports whether value is beyond the threshold
+func (t Threshold) crossed(value float64) bool {
+	return t.Below != nil && value < *t.Below || t.Above != nil && value > *t.Above
+}
+
+// cleared reports whether value is back within the threshold by the hysteresis
+func (t Threshold) cleared(value float64) bool {
+	return (t.Below == nil || value >= *t.Below+t.Hysteresis) && (t.Above == nil || value <= *t.Above-t.Hysteresis)
+}
+
+// thresholdAlertMessage is an alert raised or cleared on a topic, as
+// recorded and published
+type thresholdAlertMessage struct {
+	Time  string   `json:"time"`
+	Topic string   `json:"topic"`
+	Field string   `json:"field"`
+	Value float64  `json:"value"`
+	State string   `json:"state"`
+	Below *float64 `json:"below,omitempty"`
+	Above *float64 `json:"above,omitempty"`
+}
+
+// ThresholdMonitor checks the payloads against thresholds, tracking for each
+// topic which thresholds are in alert
+type ThresholdMonitor struct {
+	mu         sync.Mutex
+	thresholds []Threshold
+	alerting   map[string][]bool
+	topics     *topicLRU
+}
+
+// NewThresholdMonitor creates a monitor of thresholds, tracking up to
+// maxTopics topics, 0 for no limit
+func NewThresholdMonitor(thresholds []Threshold, maxTopics int) *ThresholdMonitor {
+	return &ThresholdMonitor{
+		thresholds: thresholds,
+		alerting:   make(map[string][]bool),
+		topics:     newTopicLRU("thresholds", maxTopics),
+	}
+}
+
+// Check returns the alerts raised or cleared by a payload of topic. Fields
+// that are absent or not numbers leave their alerts as they are.
+func (m *ThresholdMonitor) Check(topic string, payload map[string]any, now time.Time) []thresholdAlertMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.topics != nil {
+		if evicted, ok := m.topics.touch(topic); ok {
+			delete(m.alerting, evicted)
+		}
+	}
+	alerting, ok := m.alerting[topic]
+	if !ok {
+		alerting = make([]bool, len(m.thresholds))
+		m.alerting[topic] = alerting
+	}
+
+	var alerts []thresholdAlertMessage
+	for i, t := range m.thresholds {
+		value, ok := payload[t.Field].(float64)
+		if !ok {
+			continue
+		}
+
+		state := ""
+		if !alerting[i] && t.crossed(value) {
+			state = thresholdAlert
+		} else if alerting[i] && t.cleared(value) {
+			state = thresholdOK
+		}
+		if state == "" {
+			continue
+		}
+		alerting[i] = state == thresholdAlert
+
+		alerts = append(alerts, thresholdAlertMessage{
+			Time:  now.Format(time.RFC3339),
+			Topic: topic,
+			Field: t.Field,
+			Value: value,
+			State: state,
+			Below: t.Below,
+			Above: t.Above,
+		})
+	}
+	return alerts
+}
+
+// fields returns the fields of the alert event record
+func (a thresholdAlertMessage) fields() map[string]string {
+	fields := map[string]string{
+		"topic": a.Topic,
+		"field": a.Field,
+		"value": strconv.FormatFloat(a.Value, 'f', -1, 64),
+		"state": a.State,
+	}
+	if a.Below != nil {
+		fields["below"] = strconv.FormatFloat(*a.Below, 'f', -1, 64)
+	}
+	if a.Above != nil {
+		fields["above"] = strconv.FormatFloat(*a.Above, 'f', -1, 64)
+	}
+	return fields
+}
+
+// publishThresholdAlert publishes an alert to topic. It doesn't wait for the
+// publication, as it is called from a message handler.
+func publishThresholdAlert(client mqtt.Client, topic string, qos byte, alert thresholdAlertMessage) {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("Error encoding threshold alert: %v", err)
+		return
+	}
+	token := client.Publish(topic, qos, false, payload)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Printf("Error publishing threshold alert to %s: %v", topic, token.Error())
+		}
+	}()
+}
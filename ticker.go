@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// runEvery calls fn every interval in a goroutine. The returned function
+// stops it and waits for a running call to return.
+func runEvery(interval time.Duration, fn func()) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Records of the timeseries format, each written as its length as an
+// unsigned varint followed by its type and its data
+const (
+	// tsHeader starts the records of a run, the series defined before don't
+	// apply after it
+	tsHeader = 'H'
+	// tsSeries defines a series: its ID, topic and fields
+	tsSeries = 'S'
+	// tsPoint is a point of a series: its ID, the delta-of-delta of its
+	// time in milliseconds and its values
+	tsPoint = 'P'
+)
+
+// tsMagic follows the header record type, with the format version
+const tsMagic = "MTTS\x01"
+
+// Value encodings of the timeseries points, other values being 0x80 |
+// leading zero bytes << 3 | trailing zero bytes of the XOR with the previous
+// value, followed by its bytes in between
+const (
+	tsValueSame    = 0x00
+	tsValueMissing = 0x01
+)
+
+// tsState is the state of a series, shared by its encoder and decoder
+type tsState struct {
+	id     uint64
+	topic  string
+	fields []string
+	points int
+	time   int64 // of the last point, in milliseconds
+	delta  int64 // between the last two points
+	values []uint64
+}
+
+// nextTime returns the delta-of-delta of a point at t and moves to it
+func (s *tsState) nextTime(t int64) int64 {
+	dod := t - s.time
+	if s.points > 0 {
+		dod -= s.delta
+	}
+	s.advance(t)
+	return dod
+}
+
+// timeOf returns the time of the point at a delta-of-delta and moves to it
+func (s *tsState) timeOf(dod int64) int64 {
+	t := s.time + dod
+	if s.points > 0 {
+		t += s.delta
+	}
+	s.advance(t)
+	return t
+}
+
+// advance moves the series to a point at t
+func (s *tsState) advance(t int64) {
+	if s.points > 0 {
+		s.delta = t - s.time
+	}
+	s.time = t
+	s.points++
+}
+
+// tsEncoder encodes the messages into timeseries records: a series per topic
+// and set of output fields, whose points hold the delta-of-delta of their
+// time and the XOR of each value with the previous one, so that regular
+// messages of slowly changing values take a few bytes each
+type tsEncoder struct {
+	// mu is held from encoding records to writing them, as they must be
+	// written in order
+	mu      sync.Mutex
+	started bool
+	series  map[string]*tsState
+}
+
+// newTSEncoder creates a timeseries encoder
+func newTSEncoder() *tsEncoder {
+	return &tsEncoder{series: make(map[string]*tsState)}
+}
+
+// encode returns the records of a message of topic at t, defining its series
+// first if new. Values that are not numbers are encoded as missing.
+func (e *tsEncoder) encode(topic string, fields []string, payload map[string]any, t time.Time) string {
+	var out []byte
+	if !e.started {
+		out = appendTSRecord(out, append([]byte{tsHeader}, tsMagic...))
+		e.started = true
+	}
+
+	key := topic + "\x00" + strings.Join(fields, "\x00")
+	s, ok := e.series[key]
+	if !ok {
+		s = &tsState{id: uint64(len(e.series)), topic: topic, fields: fields, values: make([]uint64, len(fields))}
+		e.series[key] = s
+
+		def := binary.AppendUvarint([]byte{tsSeries}, s.id)
+		def = appendTSString(def, topic)
+		def = binary.AppendUvarint(def, uint64(len(fields)))
+		for _, name := range fields {
+			def = appendTSString(def, name)
+		}
+		out = appendTSRecord(out, def)
+	}
+
+	point := binary.AppendUvarint([]byte{tsPoint}, s.id)
+	point = binary.AppendVarint(point, s.nextTime(t.UnixMilli()))
+	for i, name := range fields {
+		value, ok := payload[name].(float64)
+		if !ok {
+			point = append(point, tsValueMissing)
+			continue
+		}
+		v := math.Float64bits(value)
+		xor := v ^ s.values[i]
+		s.values[i] = v
+		if xor == 0 {
+			point = append(point, tsValueSame)
+			continue
+		}
+		leading := bits.LeadingZeros64(xor) / 8
+		trailing := bits.TrailingZeros64(xor) / 8
+		point = append(point, byte(0x80|leading<<3|trailing))
+		for b := leading; b < 8-trailing; b++ {
+			point = append(point, byte(xor>>(56-8*b)))
+		}
+	}
+	return string(appendTSRecord(out, point))
+}
+
+// appendTSRecord appends a record prefixed with its length
+func appendTSRecord(out, record []byte) []byte {
+	out = binary.AppendUvarint(out, uint64(len(record)))
+	return append(out, record...)
+}
+
+// appendTSString appends a string prefixed with its length
+func appendTSString(out []byte, s string) []byte {
+	out = binary.AppendUvarint(out, uint64(len(s)))
+	return append(out, s...)
+}
+
+// isTimeseries reports whether an output file starts with a timeseries
+// header record
+func isTimeseries(r *bufio.Reader) bool {
+	start, err := r.Peek(1 + 1 + len(tsMagic))
+	return err == nil && start[0] == byte(1+len(tsMagic)) && start[1] == tsHeader && string(start[2:]) == tsMagic
+}
+
+// decodeTimeseries prints the points of a timeseries output file as JSON,
+// one per line: their time, topic and fields, null when missing
+func decodeTimeseries(path string, in *bufio.Reader, out io.Writer) error {
+	var series []*tsState
+	for {
+		size, err := binary.ReadUvarint(in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return truncatedRecord(path, err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return truncatedRecord(path, err)
+		}
+		if len(data) == 0 {
+			return fmt.Errorf("failed to decode record of %s: empty record", path)
+		}
+
+		r := &tsReader{data: data[1:]}
+		switch data[0] {
+		case tsHeader:
+			series = nil
+		case tsSeries:
+			s := &tsState{id: r.uvarint(), topic: r.string()}
+			for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+				s.fields = append(s.fields, r.string())
+			}
+			s.values = make([]uint64, len(s.fields))
+			if r.err == nil && s.id != uint64(len(series)) {
+				r.err = fmt.Errorf("series %d defined out of order", s.id)
+			}
+			series = append(series, s)
+		case tsPoint:
+			id := r.uvarint()
+			dod := r.varint()
+			if r.err != nil {
+				break
+			}
+			if id >= uint64(len(series)) {
+				r.err = fmt.Errorf("undefined series %d", id)
+				break
+			}
+			s := series[id]
+			record := map[string]any{
+				"time":  time.UnixMilli(s.timeOf(dod)).UTC().Format(time.RFC3339Nano),
+				"topic": s.topic,
+			}
+			for i, name := range s.fields {
+				if value, ok := r.value(&s.values[i]); ok {
+					record[name] = value
+				} else {
+					record[name] = nil
+				}
+			}
+			if r.err != nil {
+				break
+			}
+			line, err := encodeRecords(record, "", false)
+			if err != nil {
+				return fmt.Errorf("failed to encode record to JSON: %w", err)
+			}
+			out.Write(line)
+		default:
+			r.err = fmt.Errorf("unknown record type %q", data[0])
+		}
+		if r.err != nil {
+			return fmt.Errorf("failed to decode record of %s: %w", path, r.err)
+		}
+	}
+}
+
+// tsReader reads the data of a timeseries record, keeping the first error
+type tsReader struct {
+	data []byte
+	err  error
+}
+
+// uvarint reads an unsigned varint
+func (r *tsReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errors.New("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// varint reads a signed varint
+func (r *tsReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.err = errors.New("invalid varint")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// string reads a string prefixed with its length
+func (r *tsReader) string() string {
+	size := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if size > uint64(len(r.data)) {
+		r.err = errors.New("string past the end of the record")
+		return ""
+	}
+	s := string(r.data[:size])
+	r.data = r.data[size:]
+	return s
+}
+
+// value reads a value XORed with the previous one, updating it, and reports
+// whether it is present
+func (r *tsReader) value(prev *uint64) (float64, bool) {
+	if r.err != nil || len(r.data) == 0 {
+		if r.err == nil {
+			r.err = errors.New("value past the end of the record")
+		}
+		return 0, false
+	}
+	control := r.data[0]
+	r.data = r.data[1:]
+	switch {
+	case control == tsValueMissing:
+		return 0, false
+	case control == tsValueSame:
+		return math.Float64frombits(*prev), true
+	case control&0x80 == 0:
+		r.err = fmt.Errorf("invalid value encoding %#x", control)
+		return 0, false
+	}
+	leading := int(control>>3) & 7
+	trailing := int(control) & 7
+	size := 8 - leading - trailing
+	if size <= 0 || size > len(r.data) {
+		r.err = errors.New("value past the end of the record")
+		return 0, false
+	}
+	var xor uint64
+	for b := 0; b < size; b++ {
+		xor |= uint64(r.data[b]) << (56 - 8*(leading+b))
+	}
+	r.data = r.data[size:]
+	*prev ^= xor
+	return math.Float64frombits(*prev), true
+}
+
+// recoverTimeseries truncates a timeseries output file after its last
+// complete record, so that the records appended to it can be read back. A
+// missing or gzip-compressed file is left as is.
+func recoverTimeseries(path string) error {
+	return recoverRecords(path, func(r *bufio.Reader) (int64, int64, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		return int64(len(binary.AppendUvarint(nil, size))), int64(size), nil
+	})
+}
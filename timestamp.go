@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Actions taken on records whose payload timestamp is too far in the future
+const (
+	futureTimestampFlag = "flag"
+	futureTimestampDrop = "drop"
+)
+
+// Time fields derived from the record time with time_fields
+const (
+	timeFieldHour    = "hour"
+	timeFieldDate    = "date"
+	timeFieldWeekday = "weekday"
+	timeFieldISOWeek = "iso_week"
+	timeFieldMonth   = "month"
+)
+
+// timeFields derives the named fields from the record time t, e.g. hour=10,
+// weekday=Monday or iso_week=2024-W03
+func timeFields(t time.Time, names []string) []field {
+	fields := make([]field, 0, len(names))
+	for _, name := range names {
+		var value any
+		switch name {
+		case timeFieldHour:
+			value = t.Hour()
+		case timeFieldDate:
+			value = t.Format(time.DateOnly)
+		case timeFieldWeekday:
+			value = t.Weekday().String()
+		case timeFieldISOWeek:
+			year, week := t.ISOWeek()
+			value = fmt.Sprintf("%d-W%02d", year, week)
+		case timeFieldMonth:
+			value = t.Format("2006-01")
+		}
+		fields = append(fields, field{key: name, value: value})
+	}
+	return fields
+}
+
+// isFuture reports whether the payload timestamp value is later than now by
+// more than skew. Values that are not timestamps are never in the future.
+func isFuture(value any, now time.Time, skew time.Duration) bool {
+	t, ok := payloadTime(value)
+	return ok && t.Sub(now) > skew
+}
+
+// payloadTime interprets a payload value as a timestamp. Strings are parsed
+// as RFC3339, numbers as a Unix epoch in seconds, or in milliseconds when the
+// value is too large to be a plausible number of seconds.
+func payloadTime(value any) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return t, true
+	case float64:
+		if v > 1e11 {
+			return time.UnixMilli(int64(v)), true
+		}
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// tlsVersions maps the accepted tls.min_version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration used to connect to the broker,
+// checking the broker certificate expiry with expiry on every connection
+func newTLSConfig(config *Config, writer *FileWriter, expiry *CertExpiry) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLS.InsecureSkipVerify,
+		MinVersion:         tlsVersions[config.TLS.MinVersion],
+	}
+
+	if config.TLS.CAFile != "" || config.TLS.CADir != "" {
+		pool, err := newCertPool(config.TLS.UseSystemPool)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.TLS.CAFile != "" {
+			pem, err := os.ReadFile(config.TLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no valid certificate found in CA file %s", config.TLS.CAFile)
+			}
+		}
+
+		if config.TLS.CADir != "" {
+			if err := appendCADir(pool, config.TLS.CADir); err != nil {
+				return nil, err
+			}
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// VerifyConnection runs after the standard verification, so the state it
+	// receives is the one actually negotiated with the broker
+	var once sync.Once
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) > 0 {
+			expiry.check(state.PeerCertificates[0])
+		}
+		once.Do(func() {
+			reportTLSConnection(state, config, writer)
+		})
+		return nil
+	}
+
+	return tlsConfig, nil
+}
+
+// newCertPool returns the pool custom CAs are added to, starting from the system pool if requested
+func newCertPool(useSystemPool bool) (*x509.CertPool, error) {
+	if !useSystemPool {
+		return x509.NewCertPool(), nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load system cert pool: %w", err)
+	}
+	return pool, nil
+}
+
+// appendCADir adds every .pem and .crt file of a directory to the pool, like OpenSSL's CApath
+func appendCADir(pool *x509.CertPool, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read CA directory: %w", err)
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Printf("WARNING: no valid certificate found in %s", path)
+			continue
+		}
+		loaded++
+	}
+
+	if loaded == 0 {
+		return fmt.Errorf("no valid certificate found in CA directory %s", dir)
+	}
+	log.Printf("Loaded %d CA files from %s", loaded, dir)
+
+	return nil
+}
+
+// reportTLSConnection logs the negotiated TLS parameters
+func reportTLSConnection(state tls.ConnectionState, config *Config, writer *FileWriter) {
+	fields := map[string]string{
+		"version": tls.VersionName(state.Version),
+		"cipher":  tls.CipherSuiteName(state.CipherSuite),
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		fields["subject"] = cert.Subject.String()
+		fields["not_after"] = cert.NotAfter.Format(time.RFC3339)
+	}
+
+	log.Printf("TLS connection established: version=%s cipher=%s subject=%q not_after=%s",
+		fields["version"], fields["cipher"], fields["subject"], fields["not_after"])
+
+	if config.TLS.RecordDetails {
+		if err := writer.WriteEvent("tls", fields); err != nil {
+			log.Printf("Error saving TLS connection details: %v", err)
+		}
+	}
+}
+
+// certExpiryAlert is the payload published to tls.expiry_alert_topic
+type certExpiryAlert struct {
+	Subject       string `json:"subject"`
+	NotAfter      string `json:"not_after"`
+	ExpiresInDays int    `json:"expires_in_days"`
+}
+
+// CertExpiry warns when the broker certificate expires within a window:
+// it logs a warning and, if a topic is set, publishes an alert once connected
+type CertExpiry struct {
+	mu     sync.Mutex
+	window time.Duration
+	topic  string
+	qos    byte
+	alert  *certExpiryAlert // pending alert, published on connect
+}
+
+// NewCertExpiry creates an expiry check warning within days of the expiry,
+// publishing alerts to topic with qos unless topic is empty
+func NewCertExpiry(days int, topic string, qos byte) *CertExpiry {
+	return &CertExpiry{
+		window: time.Duration(days) * 24 * time.Hour,
+		topic:  topic,
+		qos:    qos,
+	}
+}
+
+// check accounts for the broker certificate of a new connection
+func (e *CertExpiry) check(cert *x509.Certificate) {
+	remaining := time.Until(cert.NotAfter)
+	brokerCertExpiry.Set(remaining.Seconds())
+	if remaining >= e.window {
+		return
+	}
+
+	log.Printf("WARNING: broker certificate %q expires in %s (%s)",
+		cert.Subject.String(), remaining.Truncate(time.Minute), cert.NotAfter.Format(time.RFC3339))
+
+	if e.topic == "" {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.alert = &certExpiryAlert{
+		Subject:       cert.Subject.String(),
+		NotAfter:      cert.NotAfter.Format(time.RFC3339),
+		ExpiresInDays: int(remaining.Hours() / 24),
+	}
+}
+
+// PublishAlert publishes the pending alert, if any, it is called once connected
+func (e *CertExpiry) PublishAlert(client mqtt.Client) {
+	e.mu.Lock()
+	alert := e.alert
+	e.alert = nil
+	e.mu.Unlock()
+	if alert == nil {
+		return
+	}
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("Error encoding certificate expiry alert: %v", err)
+		return
+	}
+	token := client.Publish(e.topic, e.qos, false, payload)
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		log.Printf("Error publishing certificate expiry alert to %s: %v", e.topic, token.Error())
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// TopicConfig is a subscribed topic filter along with its settings
+type TopicConfig struct {
+	Topic string `mapstructure:"topic"`
+	// QoS overrides mqtt.qos for this topic when set
+	QoS *byte `mapstructure:"qos"`
+	// SampleRatio is the fraction of the messages recorded, all when not set
+	SampleRatio *float64 `mapstructure:"sample_ratio"`
+	// Priority orders the subscriptions, higher first, 0 by default
+	Priority int `mapstructure:"priority"`
+}
+
+// topicConfigHook lets a topic be given as a plain string, the legacy
+// format, instead of an object: "a/b" is decoded as {topic: "a/b"}
+func topicConfigHook(from, to reflect.Type, data any) (any, error) {
+	if to != reflect.TypeOf(TopicConfig{}) || from.Kind() != reflect.String {
+		return data, nil
+	}
+	return TopicConfig{Topic: data.(string)}, nil
+}
+
+// topicMatches reports whether a topic matches an MQTT topic filter, where
+// "+" matches exactly one level and a trailing "#" matches any number of
+// remaining levels (including none)
+func topicMatches(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// validateTopicFilter checks the syntax of an MQTT topic filter: "#" only as
+// the last level and "+" only as a whole level
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("topic filter is empty")
+	}
+	if strings.ContainsRune(filter, 0) {
+		return fmt.Errorf("topic filter %q contains a null character", filter)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("topic filter %q: # must be the whole last level", filter)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("topic filter %q: + must be a whole level", filter)
+		}
+	}
+	return nil
+}
+
+// matchesAny reports whether a topic matches at least one of the filters
+func matchesAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// topicDepth returns the number of levels of a topic, "a/b/c" having 3
+func topicDepth(topic string) int {
+	return strings.Count(topic, "/") + 1
+}
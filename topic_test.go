@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestLoadConfigTopics(t *testing.T) {
+	qos := byte(2)
+	ratio := 0.5
+
+	tests := []struct {
+		name   string
+		topics string
+		want   []TopicConfig
+	}{
+		{
+			name:   "legacy string list",
+			topics: `["home/+/sensor", "garden/#"]`,
+			want:   []TopicConfig{{Topic: "home/+/sensor"}, {Topic: "garden/#"}},
+		},
+		{
+			name: "objects",
+			topics: `
+    - topic: home/+/sensor
+      qos: 2
+      sample_ratio: 0.5
+      priority: 10
+    - topic: garden/#`,
+			want: []TopicConfig{
+				{Topic: "home/+/sensor", QoS: &qos, SampleRatio: &ratio, Priority: 10},
+				{Topic: "garden/#"},
+			},
+		},
+		{
+			name: "mixed",
+			topics: `
+    - home/+/sensor
+    - topic: garden/#
+      qos: 2`,
+			want: []TopicConfig{{Topic: "home/+/sensor"}, {Topic: "garden/#", QoS: &qos}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			t.Cleanup(viper.Reset)
+
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			data := "mqtt:\n  broker: localhost\n  topics: " + tt.topics + "\n"
+			if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if !reflect.DeepEqual(config.MQTT.Topics, tt.want) {
+				t.Errorf("topics = %s, want %s", formatTopics(config.MQTT.Topics), formatTopics(tt.want))
+			}
+		})
+	}
+}
+
+// formatTopics prints topic configurations with their optional settings
+// dereferenced
+func formatTopics(topics []TopicConfig) string {
+	var s []string
+	for _, topic := range topics {
+		f := topic.Topic
+		if topic.QoS != nil {
+			f += fmt.Sprintf(" qos=%d", *topic.QoS)
+		}
+		if topic.SampleRatio != nil {
+			f += fmt.Sprintf(" sample_ratio=%g", *topic.SampleRatio)
+		}
+		if topic.Priority != 0 {
+			f += fmt.Sprintf(" priority=%d", topic.Priority)
+		}
+		s = append(s, "{"+f+"}")
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
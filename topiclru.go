@@ -0,0 +1,53 @@
+package main
+
+import (
+	"container/list"
+	"log"
+)
+
+// topicLRU bounds the number of topics some per-topic bookkeeping tracks:
+// once more than max topics are tracked, the least recently seen one is
+// evicted. It is not safe for concurrent use, callers hold their own lock.
+type topicLRU struct {
+	name  string // what is tracked, for the eviction logs
+	max   int
+	order *list.List
+	elems map[string]*list.Element
+}
+
+// newTopicLRU creates an LRU tracking up to max topics, or nil if max is 0
+// (no limit)
+func newTopicLRU(name string, max int) *topicLRU {
+	if max == 0 {
+		return nil
+	}
+	return &topicLRU{
+		name:  name,
+		max:   max,
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+// touch marks topic as the most recently seen. If tracking it exceeds the
+// limit, the least recently seen topic is evicted and returned.
+func (l *topicLRU) touch(topic string) (string, bool) {
+	if elem, ok := l.elems[topic]; ok {
+		l.order.MoveToFront(elem)
+		return "", false
+	}
+
+	l.elems[topic] = l.order.PushFront(topic)
+	if l.order.Len() <= l.max {
+		return "", false
+	}
+
+	oldest := l.order.Back()
+	l.order.Remove(oldest)
+	evicted := oldest.Value.(string)
+	delete(l.elems, evicted)
+
+	evictedTopics.WithLabelValues(l.name).Inc()
+	log.Printf("Evicted topic %s from %s, max_tracked_topics (%d) reached", evicted, l.name, l.max)
+	return evicted, true
+}
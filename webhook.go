@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// webhookQueueSize bounds the events waiting to be posted, the next ones
+	// being dropped
+	webhookQueueSize = 100
+	// webhookMinBackoff is the wait before the first retry, doubling with
+	// each retry
+	webhookMinBackoff = time.Second
+)
+
+// webhookEvent is the JSON body of an event posted to the webhook
+type webhookEvent struct {
+	Event  string `json:"event"`
+	Broker string `json:"broker"`
+	Time   string `json:"time"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// EventWebhook posts the connection lifecycle events to a webhook, in order
+// and in the background, retrying failed posts with a growing backoff. A nil
+// EventWebhook posts nothing.
+type EventWebhook struct {
+	url        string
+	client     *http.Client
+	maxRetries int
+	location   *time.Location
+	queue      chan webhookEvent
+	done       chan struct{}
+	wg         sync.WaitGroup
+
+	mu sync.Mutex
+	// broker is the host:port of the broker connections are made to
+	broker string
+	// connected tells whether a connection was established before, the
+	// next ones being reconnections
+	connected bool
+}
+
+// NewEventWebhook creates a webhook posting to url, connections being made
+// to broker, or returns nil if url is empty
+func NewEventWebhook(url string, timeout time.Duration, maxRetries int, broker string, location *time.Location) *EventWebhook {
+	if url == "" {
+		return nil
+	}
+	w := &EventWebhook{
+		url:        url,
+		client:     &http.Client{Timeout: timeout},
+		maxRetries: maxRetries,
+		location:   location,
+		queue:      make(chan webhookEvent, webhookQueueSize),
+		done:       make(chan struct{}),
+		broker:     broker,
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Post queues an event with its reason, if any, to be posted
+func (w *EventWebhook) Post(event, reason string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	broker := w.broker
+	w.mu.Unlock()
+
+	select {
+	case w.queue <- webhookEvent{
+		Event:  event,
+		Broker: broker,
+		Time:   time.Now().In(w.location).Format(time.RFC3339),
+		Reason: reason,
+	}:
+	default:
+		log.Printf("Event webhook queue full, dropping %s event", event)
+	}
+}
+
+// Notify posts the connection lifecycle as a connection notification
+// handler: the connections, telling the reconnections apart, and the lost
+// connections with their reason
+func (w *EventWebhook) Notify(client mqtt.Client, notification mqtt.ConnectionNotification) {
+	if w == nil {
+		return
+	}
+	switch n := notification.(type) {
+	case mqtt.ConnectionNotificationConnected:
+		w.mu.Lock()
+		event := "connected"
+		if w.connected {
+			event = "reconnected"
+		}
+		w.connected = true
+		w.mu.Unlock()
+		w.Post(event, "")
+	case mqtt.ConnectionNotificationLost:
+		reason := "unknown"
+		if n.Reason != nil {
+			reason = n.Reason.Error()
+		}
+		w.Post("connection_lost", reason)
+	}
+}
+
+// SetBroker changes the broker of the next events, e.g. after a failover
+func (w *EventWebhook) SetBroker(broker string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.broker = broker
+}
+
+// run posts the queued events until closed, then the ones left
+func (w *EventWebhook) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case event := <-w.queue:
+			w.deliver(event)
+		case <-w.done:
+			for {
+				select {
+				case event := <-w.queue:
+					w.deliver(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver posts an event, retrying up to maxRetries times on network errors
+// and server errors. Retries are not waited for once closed.
+func (w *EventWebhook) deliver(event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding %s event for the webhook: %v", event.Event, err)
+		return
+	}
+
+	backoff := webhookMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.maxRetries {
+			log.Printf("Error posting %s event to the webhook, giving up: %v", event.Event, err)
+			return
+		}
+		log.Printf("Error posting %s event to the webhook, retrying in %s: %v", event.Event, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-w.done:
+			log.Printf("Not retrying %s event when stopping", event.Event)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post posts a body once, and tells whether a failure is worth retrying
+func (w *EventWebhook) post(body []byte) (bool, error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// Close posts the events left, without retrying them, and stops
+func (w *EventWebhook) Close() {
+	if w == nil {
+		return
+	}
+	close(w.done)
+	w.wg.Wait()
+}